@@ -0,0 +1,23 @@
+// Package arith defines the types and
+// methods shared by the arith client
+// and server.
+package arith
+
+import (
+	"context"
+)
+
+//go:generate msgp -io=false
+//go:generate synapsegen -type=Arith
+
+type Num struct {
+	Value float64 `msg:"val"`
+}
+
+// Arith is the interface implemented
+// by the server. synapsegen produces
+// a client that implements the same
+// interface.
+type Arith interface {
+	Double(ctx context.Context, in *Num) (*Num, error)
+}
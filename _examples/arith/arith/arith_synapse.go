@@ -0,0 +1,66 @@
+// Code generated by synapsegen; DO NOT EDIT.
+
+package arith
+
+import (
+	"context"
+
+	"github.com/tinylib/synapse"
+)
+
+// Method IDs for Arith. These match the
+// numbering used by synapse.RegisterService.
+const (
+	ArithDouble synapse.Method = iota
+)
+
+// ArithClient calls Arith
+// methods on a remote server.
+type ArithClient struct {
+	c *synapse.Client
+}
+
+// NewArithClient returns a client
+// for Arith that makes calls using 'c'.
+func NewArithClient(c *synapse.Client) *ArithClient {
+	return &ArithClient{c: c}
+}
+
+var _ Arith = (*ArithClient)(nil)
+
+// Double calls Arith.Double on the server.
+func (c *ArithClient) Double(ctx context.Context, in *Num) (*Num, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	out := new(Num)
+	err := c.c.CallContext(ctx, ArithDouble, in, out)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// NewArithHandler returns a synapse.Handler
+// that dispatches calls to 'impl'.
+func NewArithHandler(impl Arith) synapse.Handler {
+	return &synapse.RouteTable{
+		ArithDouble: synapse.HandlerFunc(func(req synapse.Request, res synapse.ResponseWriter) {
+			in := new(Num)
+			if err := req.Decode(in); err != nil {
+				res.Error(synapse.StatusBadRequest, err.Error())
+				return
+			}
+			out, err := impl.Double(synapse.RequestContext(req), in)
+			if err != nil {
+				synapse.SendError(res, err)
+				return
+			}
+			if out == nil {
+				res.Send(nil)
+				return
+			}
+			res.Send(out)
+		}),
+	}
+}
@@ -1,19 +1,13 @@
 package main
 
 import (
+	"context"
 	"fmt"
-	"github.com/tinylib/synapse"
-	"os"
 	"time"
-)
-
-//go:generate msgp -io=false
-
-type Num struct {
-	Value float64 `msg:"val"`
-}
 
-const Double synapse.Method = 0
+	"github.com/tinylib/synapse"
+	"github.com/tinylib/synapse/_examples/arith/arith"
+)
 
 func main() {
 	cl, err := synapse.Dial("tcp", "localhost:7000", time.Second)
@@ -23,12 +17,13 @@ func main() {
 	}
 	defer cl.Close()
 
-	pi := 3.14159
-	num := Num{Value: pi}
+	ar := arith.NewArithClient(cl)
 
 	fmt.Println("Asking the remote server to double 3.14159 for us...")
-	err = cl.Call(Double, &num, synapse.JSPipe(os.Stdout))
+	res, err := ar.Double(context.Background(), &arith.Num{Value: 3.14159})
 	if err != nil {
 		fmt.Println("ERROR:", err)
+		return
 	}
+	fmt.Println("result:", res.Value)
 }
@@ -1,39 +1,27 @@
 package main
 
 import (
+	"context"
 	"fmt"
-	"github.com/tinylib/synapse"
 	"net"
-)
-
-//go:generate msgp -io=false
-
-type Num struct {
-	Value float64 `msg:"val"`
-}
 
-const Double synapse.Method = 0
+	"github.com/tinylib/synapse"
+	"github.com/tinylib/synapse/_examples/arith/arith"
+)
 
-type doubleHandler struct{}
+// doubler implements arith.Arith
+type doubler struct{}
 
-func (d doubleHandler) ServeCall(req synapse.Request, res synapse.ResponseWriter) {
-	var n Num
-	err := req.Decode(&n)
-	if err != nil {
-		res.Error(synapse.StatusBadRequest, err.Error())
-		return
-	}
-	n.Value *= 2
-	res.Send(&n)
+func (d doubler) Double(ctx context.Context, in *arith.Num) (*arith.Num, error) {
+	return &arith.Num{Value: in.Value * 2}, nil
 }
 
 func main() {
-	rt := synapse.RouteTable{Double: doubleHandler{}}
 	l, err := net.Listen("tcp", "localhost:7000")
 	if err != nil {
 		fmt.Println(err)
 		return
 	}
-	fmt.Println("listening on :7070...")
-	fmt.Println(synapse.Serve(l, &rt))
+	fmt.Println("listening on :7000...")
+	fmt.Println(synapse.Serve(l, arith.NewArithHandler(doubler{})))
 }
@@ -0,0 +1,254 @@
+package synapse
+
+import (
+	"bytes"
+	"log/slog"
+	"sync/atomic"
+	"time"
+
+	"github.com/tinylib/msgp/msgp"
+)
+
+// Verbosity determines how much
+// AccessLog records about a call.
+type Verbosity int
+
+const (
+	// LogCalls logs one record per
+	// call, without the bodies.
+	LogCalls Verbosity = iota
+
+	// LogBodies logs one record per call,
+	// including the request and response
+	// bodies as JSON.
+	LogBodies
+
+	// LogOff doesn't log calls.
+	LogOff
+)
+
+// AccessLogOptions configures AccessLog.
+// The zero value logs every call at
+// slog.LevelInfo without bodies.
+type AccessLogOptions struct {
+	// Level is the level of records
+	// for successful calls. Failed calls
+	// are logged at slog.LevelWarn, or
+	// at Level if it is higher.
+	Level slog.Level
+
+	// Verbosity is the default
+	// verbosity for every method.
+	Verbosity Verbosity
+
+	// Methods overrides Verbosity
+	// for individual methods.
+	Methods map[Method]Verbosity
+
+	// Sample, if greater than 1, logs
+	// only one out of every Sample
+	// successful calls. Failed calls
+	// are always logged.
+	Sample int
+
+	// Redact is applied to
+	// logged bodies.
+	Redact Redaction
+}
+
+// AccessLog returns a Middleware that logs each
+// call to 'l' as a single structured record with
+// the attributes
+//
+//  method        method name
+//  remote        remote address
+//  status        response status
+//  duration      time spent in the handler
+//  request_size  size of the encoded request body
+//  response_size size of the encoded response body
+//  error         explanation, for failed calls
+//  request       request body as JSON, with LogBodies
+//  response      response body as JSON, with LogBodies
+//
+// If 'l' is nil, slog.Default() is used.
+func AccessLog(l *slog.Logger, opts AccessLogOptions) Middleware {
+	if l == nil {
+		l = slog.Default()
+	}
+	return func(h Handler) Handler {
+		return &accessh{inner: h, logger: l, opts: opts, redact: opts.Redact.compile()}
+	}
+}
+
+type accessh struct {
+	inner  Handler
+	logger *slog.Logger
+	opts   AccessLogOptions
+	redact *redactor
+	calls  uint64 // for sampling; atomic
+}
+
+// Methods implements MethodLister
+// if the wrapped handler does.
+func (a *accessh) Methods() []MethodInfo { return HandlerMethods(a.inner) }
+
+func (a *accessh) verbosity(m Method) Verbosity {
+	if v, ok := a.opts.Methods[m]; ok {
+		return v
+	}
+	return a.opts.Verbosity
+}
+
+// sampled returns whether or not a
+// successful call should be logged
+func (a *accessh) sampled() bool {
+	return a.opts.Sample <= 1 || atomic.AddUint64(&a.calls, 1)%uint64(a.opts.Sample) == 0
+}
+
+func (a *accessh) level(s Status) slog.Level {
+	if s != StatusOK && a.opts.Level < slog.LevelWarn {
+		return slog.LevelWarn
+	}
+	return a.opts.Level
+}
+
+// jsonBody is a msgpack body converted
+// to JSON. it is logged as raw JSON by
+// JSON handlers, and as text otherwise.
+type jsonBody []byte
+
+func (j jsonBody) MarshalJSON() ([]byte, error) { return j, nil }
+func (j jsonBody) MarshalText() ([]byte, error) { return j, nil }
+
+// toJSON converts a msgpack body of a call
+// to 'm' to a loggable attribute. truncated
+// bodies aren't valid JSON, so they are
+// logged as strings.
+func (a *accessh) toJSON(key string, m Method, b []byte) slog.Attr {
+	var buf bytes.Buffer
+	truncated, err := a.redact.json(&buf, m, b)
+	if err != nil {
+		return slog.String(key, "malformed: "+err.Error())
+	}
+	if truncated {
+		return slog.String(key, buf.String())
+	}
+	return slog.Any(key, jsonBody(buf.Bytes()))
+}
+
+func (a *accessh) ServeCall(req Request, res ResponseWriter) {
+	v := a.verbosity(req.Method())
+	if v == LogOff {
+		a.inner.ServeCall(req, res)
+		return
+	}
+
+	// if we're handed the base types
+	// used by the package, the response
+	// can be read directly out of its buffer
+	if rq, ok := req.(*request); ok {
+		if rs, ok := res.(*response); ok {
+			a.serveBase(rq, rs, v)
+			return
+		}
+	}
+
+	raw, ok := req.(RawRequest)
+	if !ok {
+		raw = RequestWithContext(req, RequestContext(req)).(RawRequest)
+	}
+	in := raw.Body()
+	w := &mockRes{}
+	start := time.Now()
+	a.inner.ServeCall(raw, w)
+	elapsed := time.Since(start)
+	if !w.wrote {
+		w.Send(nil)
+	}
+	if w.err != nil {
+		SendError(res, w.err)
+	} else {
+		res.Send(msgp.Raw(w.out))
+	}
+
+	var expl string
+	var body []byte
+	if w.err != nil {
+		expl = w.err.Expl
+	} else {
+		body = w.out
+	}
+	a.log(req, v, w.status, elapsed, in, len(w.out), body, expl)
+}
+
+func (a *accessh) serveBase(req *request, res *response, v Verbosity) {
+	start := time.Now()
+	a.inner.ServeCall(req, res)
+	elapsed := time.Since(start)
+
+	// if the handler didn't write
+	// a response, 'nil' is sent
+	status := StatusOK
+	body := nilBody
+	size := len(body)
+	var expl string
+	if res.wrote && len(res.out) > leadSize {
+		out := res.out[leadSize:]
+		code, rest, err := msgp.ReadIntBytes(out)
+		if err != nil {
+			status = StatusInvalid
+		} else {
+			status = Status(code)
+		}
+		size = len(rest)
+		if status == StatusOK {
+			body = rest
+		} else {
+			expl, _, _ = msgp.ReadStringBytes(rest)
+		}
+	}
+	a.log(req, v, status, elapsed, req.in, size, body, expl)
+}
+
+// log writes the record for a call. 'body'
+// is the response body for successful calls,
+// and 'expl' is the explanation for failed ones.
+func (a *accessh) log(req Request, v Verbosity, status Status, elapsed time.Duration, in []byte, outsize int, body []byte, expl string) {
+	if status == StatusOK && !a.sampled() {
+		return
+	}
+	ctx := RequestContext(req)
+	level := a.level(status)
+	if !a.logger.Enabled(ctx, level) {
+		return
+	}
+	attrs := make([]slog.Attr, 0, 9)
+	attrs = append(attrs,
+		slog.String("method", req.Method().String()),
+		slog.String("remote", addrString(req)),
+		slog.String("status", status.String()),
+		slog.Duration("duration", elapsed),
+		slog.Int("request_size", len(in)),
+		slog.Int("response_size", outsize),
+	)
+	if status != StatusOK {
+		attrs = append(attrs, slog.String("error", expl))
+	}
+	if v == LogBodies {
+		attrs = append(attrs, a.toJSON("request", req.Method(), in))
+		if status == StatusOK {
+			attrs = append(attrs, a.toJSON("response", req.Method(), body))
+		}
+	}
+	a.logger.LogAttrs(ctx, level, "call", attrs...)
+}
+
+// the encoding of 'nil'
+var nilBody = []byte{0xc0}
+
+func addrString(req Request) string {
+	if addr := req.RemoteAddr(); addr != nil {
+		return addr.String()
+	}
+	return ""
+}
@@ -0,0 +1,90 @@
+package synapse
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAccessLog(t *testing.T) {
+	var buf bytes.Buffer
+	l := slog.New(slog.NewJSONHandler(&buf, nil))
+
+	mw := AccessLog(l, AccessLogOptions{
+		Methods: map[Method]Verbosity{
+			Echo: LogBodies,
+			Nop:  LogOff,
+		},
+		Sample: 2,
+	})
+	rt := &RouteTable{Echo: EchoHandler{}, Nop: NopHandler{}, Fail: FailHandler{}}
+
+	// the base types, and then a wrapped
+	// Request and ResponseWriter
+	handlers := map[string]Handler{
+		"base":    mw(rt),
+		"wrapped": Chain(mw, Tracing(&MemoryExporter{}))(rt),
+	}
+	for name, h := range handlers {
+		buf.Reset()
+		srv, cln := net.Pipe()
+		go ServeConn(srv, h)
+		cl, err := NewClient(cln, time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		in := testData("logged")
+		for i := 0; i < 4; i++ {
+			if err := cl.Call(Echo, &in, nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := cl.Call(Nop, nil, nil); err != nil {
+			t.Fatal(err)
+		}
+		if err := cl.Call(Fail, nil, nil); err == nil {
+			t.Fatal("expected an error")
+		}
+		cl.Close()
+
+		var recs []map[string]interface{}
+		for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+			var rec map[string]interface{}
+			if err := json.Unmarshal([]byte(line), &rec); err != nil {
+				t.Fatalf("%s: bad record %q: %s", name, line, err)
+			}
+			recs = append(recs, rec)
+		}
+
+		// two out of four echoes are sampled,
+		// nop is off, and failures are always logged
+		if len(recs) != 3 {
+			t.Fatalf("%s: expected 3 records; got %d:\n%s", name, len(recs), buf.String())
+		}
+		for _, rec := range recs[:2] {
+			if rec["method"] != "echo" || rec["status"] != "OK" || rec["level"] != "INFO" {
+				t.Errorf("%s: unexpected record %v", name, rec)
+			}
+			// binary is base64-encoded as JSON
+			if rec["request"] != "bG9nZ2Vk" || rec["response"] != "bG9nZ2Vk" {
+				t.Errorf("%s: expected bodies in %v", name, rec)
+			}
+			if rec["request_size"] != float64(len(in)+2) {
+				t.Errorf("%s: request_size is %v", name, rec["request_size"])
+			}
+		}
+		fail := recs[2]
+		if fail["method"] != "fail" || fail["status"] != "server error" ||
+			fail["level"] != "WARN" || fail["error"] != "try again later" {
+			t.Errorf("%s: unexpected record %v", name, fail)
+		}
+		if _, ok := fail["request"]; ok {
+			t.Errorf("%s: unexpected body in %v", name, fail)
+		}
+	}
+}
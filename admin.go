@@ -0,0 +1,463 @@
+package synapse
+
+import (
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/tinylib/msgp/msgp"
+)
+
+// Introspection enables the state command on a
+// server, which lets clients call ServerState.
+// It is off by default because it reveals the
+// addresses of every connected client, and
+// because it makes the server keep track of
+// every request in progress. It has no effect
+// on clients.
+//
+// The state command doesn't pass through the
+// server's Handler, so Authenticate doesn't
+// apply to it. If any verifiers are provided,
+// the command is only answered on connections
+// accepted by one of them. The command carries
+// no metadata, so only verifiers that check
+// the connection itself, like CertAuth, can
+// accept it.
+func Introspection(v ...Verifier) Option {
+	return func(c *config) {
+		c.introspect = true
+		c.inspectors = v
+	}
+}
+
+// inspectorOK returns whether the
+// peer may use the state command
+func (c *connHandler) inspectorOK() bool {
+	if len(c.cfg.inspectors) == 0 {
+		return true
+	}
+	req := &mockReq{remote: c.remote, tls: c.tls, raw: msgp.AppendMapHeader(nil, 0)}
+	for _, v := range c.cfg.inspectors {
+		if _, err := v.Verify(req); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// ServerState is a snapshot of
+// the live state of a Server.
+type ServerState struct {
+	Uptime    time.Duration // time since the server was created
+	Conns     int           // number of open connections
+	Pool      PoolStats     // the server's pool of request state
+	Connected []ConnState   // open connections, oldest first
+	Truncated bool          // Connected was cut short to fit in a message
+}
+
+// ConnState describes one
+// connection to a server.
+type ConnState struct {
+	Remote    string         // remote address
+	Age       time.Duration  // time since the connection was opened
+	RTT       time.Duration  // last keepalive round-trip time, or 0
+	Requests  []RequestState // requests in progress, oldest first
+	Truncated bool           // Requests was cut short to fit in a message
+}
+
+// RequestState describes a request
+// that is being handled by a server.
+type RequestState struct {
+	Seq    uint64        // sequence number
+	Method Method        // method called
+	Age    time.Duration // time since the handler started
+}
+
+// active is the tracking
+// state of a request in
+// progress
+type active struct {
+	seq    uint64
+	method Method
+	start  time.Time
+}
+
+// addConn and removeConn keep
+// track of the server's open
+// connections
+func (s *Server) addConn(c *connHandler) {
+	s.clock.Lock()
+	if s.conns == nil {
+		s.conns = make(map[*connHandler]struct{})
+	}
+	s.conns[c] = struct{}{}
+	s.clock.Unlock()
+}
+
+func (s *Server) removeConn(c *connHandler) {
+	s.clock.Lock()
+	delete(s.conns, c)
+	s.clock.Unlock()
+}
+
+// track and untrack surround the
+// call to the handler for a request
+func (c *connHandler) track(cw *connWrapper) {
+	c.alock.Lock()
+	if c.active == nil {
+		c.active = make(map[*connWrapper]active)
+	}
+	c.active[cw] = active{seq: cw.seq, method: Method(cw.req.mtd), start: time.Now()}
+	c.alock.Unlock()
+}
+
+func (c *connHandler) untrack(cw *connWrapper) {
+	c.alock.Lock()
+	delete(c.active, cw)
+	c.alock.Unlock()
+}
+
+// state returns the state
+// of the connection
+func (c *connHandler) state(now time.Time) ConnState {
+	cs := ConnState{
+		Age: now.Sub(c.since),
+		RTT: time.Duration(atomic.LoadInt64(&c.rtt)),
+	}
+	if c.remote != nil {
+		cs.Remote = c.remote.String()
+	}
+	c.alock.Lock()
+	if len(c.active) > 0 {
+		cs.Requests = make([]RequestState, 0, len(c.active))
+		for _, a := range c.active {
+			cs.Requests = append(cs.Requests, RequestState{
+				Seq:    a.seq,
+				Method: a.method,
+				Age:    now.Sub(a.start),
+			})
+		}
+	}
+	c.alock.Unlock()
+	sort.Slice(cs.Requests, func(i, j int) bool {
+		return cs.Requests[i].Age > cs.Requests[j].Age
+	})
+	return cs
+}
+
+// State returns a snapshot of the server's
+// connections and requests in progress.
+// Requests are only tracked if the server
+// was created with Introspection.
+func (s *Server) State() ServerState {
+	now := time.Now()
+	s.clock.Lock()
+	conns := make([]*connHandler, 0, len(s.conns))
+	for c := range s.conns {
+		conns = append(conns, c)
+	}
+	s.clock.Unlock()
+
+	st := ServerState{
+		Uptime:    now.Sub(s.start),
+		Conns:     len(conns),
+		Pool:      s.PoolStats(),
+		Connected: make([]ConnState, len(conns)),
+	}
+	for i, c := range conns {
+		st.Connected[i] = c.state(now)
+	}
+	sort.Slice(st.Connected, func(i, j int) bool {
+		return st.Connected[i].Age > st.Connected[j].Age
+	})
+	return st
+}
+
+// ServerState asks the server for a snapshot
+// of its state. It returns an error if the
+// server wasn't created with Introspection.
+func (c *Client) ServerState() (ServerState, error) {
+	var st ServerState
+	err := c.sendCommand(cmdState, nil, &st)
+	return st, err
+}
+
+// getState is the state command
+type getState struct{}
+
+func (g getState) Client(cl *Client, res []byte) {}
+
+func (g getState) Server(ch *connHandler, body []byte) ([]byte, error) {
+	if !ch.cfg.introspect || !ch.inspectorOK() {
+		return nil, errInvalidCmd
+	}
+	st := ch.srv.State()
+	return st.MarshalMsg(nil)
+}
+
+// like methodList, the wire representation
+// of ServerState uses maps so that fields
+// can be added later. connections that don't
+// fit in one message are left out, and so are
+// the requests of a connection that doesn't
+// fit by itself.
+
+// MarshalMsg implements msgp.Marshaler
+func (s *ServerState) MarshalMsg(b []byte) ([]byte, error) {
+	// leave room for the command byte,
+	// the other fields, and the array header
+	const room = maxMessageSize - 256
+
+	var conns []byte
+	n := 0
+	for i := range s.Connected {
+		next, ok := s.Connected[i].appendMsg(conns, room)
+		if !ok {
+			break
+		}
+		conns = next
+		n++
+	}
+	b = msgp.AppendMapHeader(b, 5)
+	b = msgp.AppendString(b, "uptime")
+	b = msgp.AppendInt64(b, int64(s.Uptime))
+	b = msgp.AppendString(b, "conns")
+	b = msgp.AppendInt(b, s.Conns)
+	b = msgp.AppendString(b, "pool")
+	b = appendPoolStats(b, &s.Pool)
+	b = msgp.AppendString(b, "truncated")
+	b = msgp.AppendBool(b, s.Truncated || n < len(s.Connected))
+	b = msgp.AppendString(b, "connected")
+	b = msgp.AppendArrayHeader(b, uint32(n))
+	return append(b, conns...), nil
+}
+
+// UnmarshalMsg implements msgp.Unmarshaler
+func (s *ServerState) UnmarshalMsg(b []byte) ([]byte, error) {
+	*s = ServerState{}
+	fields, b, err := msgp.ReadMapHeaderBytes(b)
+	if err != nil {
+		return b, err
+	}
+	for ; fields > 0; fields-- {
+		var key []byte
+		key, b, err = msgp.ReadMapKeyZC(b)
+		if err != nil {
+			return b, err
+		}
+		switch msgp.UnsafeString(key) {
+		case "uptime":
+			s.Uptime, b, err = readDuration(b)
+		case "conns":
+			s.Conns, b, err = msgp.ReadIntBytes(b)
+		case "pool":
+			b, err = readPoolStats(b, &s.Pool)
+		case "truncated":
+			s.Truncated, b, err = msgp.ReadBoolBytes(b)
+		case "connected":
+			var sz uint32
+			sz, b, err = msgp.ReadArrayHeaderBytes(b)
+			if err != nil {
+				return b, err
+			}
+			// every entry takes at least one byte
+			if uint64(sz) > uint64(len(b)) {
+				return b, msgp.ErrShortBytes
+			}
+			s.Connected = make([]ConnState, sz)
+			for i := range s.Connected {
+				b, err = s.Connected[i].readMsg(b)
+				if err != nil {
+					return b, err
+				}
+			}
+		default:
+			b, err = msgp.Skip(b)
+		}
+		if err != nil {
+			return b, err
+		}
+	}
+	return b, nil
+}
+
+// appendMsg appends the connection to 'b', leaving
+// out the requests that would make 'b' longer than
+// 'max'. it returns false if the connection doesn't
+// fit at all.
+func (c *ConnState) appendMsg(b []byte, max int) ([]byte, bool) {
+	// room for the array header
+	// and the truncated field
+	const tail = 16
+
+	start := len(b)
+	b = msgp.AppendMapHeader(b, 5)
+	b = msgp.AppendString(b, "remote")
+	b = msgp.AppendString(b, c.Remote)
+	b = msgp.AppendString(b, "age")
+	b = msgp.AppendInt64(b, int64(c.Age))
+	b = msgp.AppendString(b, "rtt")
+	b = msgp.AppendInt64(b, int64(c.RTT))
+	b = msgp.AppendString(b, "requests")
+	if len(b)+tail > max {
+		return b[:start], false
+	}
+	var reqs []byte
+	n := 0
+	for i := range c.Requests {
+		next := c.Requests[i].appendMsg(reqs)
+		if len(b)+len(next)+tail > max {
+			break
+		}
+		reqs = next
+		n++
+	}
+	b = msgp.AppendArrayHeader(b, uint32(n))
+	b = append(b, reqs...)
+	b = msgp.AppendString(b, "truncated")
+	b = msgp.AppendBool(b, c.Truncated || n < len(c.Requests))
+	return b, true
+}
+
+func (r *RequestState) appendMsg(b []byte) []byte {
+	b = msgp.AppendMapHeader(b, 3)
+	b = msgp.AppendString(b, "seq")
+	b = msgp.AppendUint64(b, r.Seq)
+	b = msgp.AppendString(b, "method")
+	b = msgp.AppendUint32(b, uint32(r.Method))
+	b = msgp.AppendString(b, "age")
+	b = msgp.AppendInt64(b, int64(r.Age))
+	return b
+}
+
+func (c *ConnState) readMsg(b []byte) ([]byte, error) {
+	fields, b, err := msgp.ReadMapHeaderBytes(b)
+	if err != nil {
+		return b, err
+	}
+	for ; fields > 0; fields-- {
+		var key []byte
+		key, b, err = msgp.ReadMapKeyZC(b)
+		if err != nil {
+			return b, err
+		}
+		switch msgp.UnsafeString(key) {
+		case "remote":
+			c.Remote, b, err = msgp.ReadStringBytes(b)
+		case "age":
+			c.Age, b, err = readDuration(b)
+		case "rtt":
+			c.RTT, b, err = readDuration(b)
+		case "truncated":
+			c.Truncated, b, err = msgp.ReadBoolBytes(b)
+		case "requests":
+			var sz uint32
+			sz, b, err = msgp.ReadArrayHeaderBytes(b)
+			if err != nil {
+				return b, err
+			}
+			// every entry takes at least one byte
+			if uint64(sz) > uint64(len(b)) {
+				return b, msgp.ErrShortBytes
+			}
+			c.Requests = make([]RequestState, sz)
+			for i := range c.Requests {
+				b, err = c.Requests[i].readMsg(b)
+				if err != nil {
+					return b, err
+				}
+			}
+		default:
+			b, err = msgp.Skip(b)
+		}
+		if err != nil {
+			return b, err
+		}
+	}
+	return b, nil
+}
+
+func (r *RequestState) readMsg(b []byte) ([]byte, error) {
+	fields, b, err := msgp.ReadMapHeaderBytes(b)
+	if err != nil {
+		return b, err
+	}
+	for ; fields > 0; fields-- {
+		var key []byte
+		key, b, err = msgp.ReadMapKeyZC(b)
+		if err != nil {
+			return b, err
+		}
+		switch msgp.UnsafeString(key) {
+		case "seq":
+			r.Seq, b, err = msgp.ReadUint64Bytes(b)
+		case "method":
+			var m uint32
+			m, b, err = msgp.ReadUint32Bytes(b)
+			r.Method = Method(m)
+		case "age":
+			r.Age, b, err = readDuration(b)
+		default:
+			b, err = msgp.Skip(b)
+		}
+		if err != nil {
+			return b, err
+		}
+	}
+	return b, nil
+}
+
+// durations are sent
+// as nanoseconds
+func readDuration(b []byte) (time.Duration, []byte, error) {
+	ns, b, err := msgp.ReadInt64Bytes(b)
+	return time.Duration(ns), b, err
+}
+
+func appendPoolStats(b []byte, p *PoolStats) []byte {
+	b = msgp.AppendMapHeader(b, 5)
+	b = msgp.AppendString(b, "hits")
+	b = msgp.AppendUint64(b, p.Hits)
+	b = msgp.AppendString(b, "misses")
+	b = msgp.AppendUint64(b, p.Misses)
+	b = msgp.AppendString(b, "drops")
+	b = msgp.AppendUint64(b, p.Drops)
+	b = msgp.AppendString(b, "idle")
+	b = msgp.AppendInt(b, p.Idle)
+	b = msgp.AppendString(b, "cap")
+	b = msgp.AppendInt(b, p.Cap)
+	return b
+}
+
+func readPoolStats(b []byte, p *PoolStats) ([]byte, error) {
+	fields, b, err := msgp.ReadMapHeaderBytes(b)
+	if err != nil {
+		return b, err
+	}
+	for ; fields > 0; fields-- {
+		var key []byte
+		key, b, err = msgp.ReadMapKeyZC(b)
+		if err != nil {
+			return b, err
+		}
+		switch msgp.UnsafeString(key) {
+		case "hits":
+			p.Hits, b, err = msgp.ReadUint64Bytes(b)
+		case "misses":
+			p.Misses, b, err = msgp.ReadUint64Bytes(b)
+		case "drops":
+			p.Drops, b, err = msgp.ReadUint64Bytes(b)
+		case "idle":
+			p.Idle, b, err = msgp.ReadIntBytes(b)
+		case "cap":
+			p.Cap, b, err = msgp.ReadIntBytes(b)
+		default:
+			b, err = msgp.Skip(b)
+		}
+		if err != nil {
+			return b, err
+		}
+	}
+	return b, nil
+}
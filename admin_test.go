@@ -0,0 +1,178 @@
+package synapse
+
+import (
+	"crypto/tls"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/tinylib/msgp/msgp"
+)
+
+func TestServerState(t *testing.T) {
+	stuck := make(chan struct{})
+	h := HandlerFunc(func(req Request, res ResponseWriter) {
+		<-stuck
+	})
+	srv := NewServer(h, Introspection())
+	s, c := net.Pipe()
+	go srv.ServeConn(s)
+	cl, err := NewClient(c, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cl.Close()
+
+	done := make(chan error, 1)
+	go func() { done <- cl.Call(Echo, nil, nil) }()
+
+	// wait for the handler to start
+	var st ServerState
+	for i := 0; ; i++ {
+		st, err = cl.ServerState()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(st.Connected) == 1 && len(st.Connected[0].Requests) == 1 {
+			break
+		}
+		if i == 100 {
+			t.Fatalf("request never showed up: %+v", st)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if st.Conns != 1 || st.Uptime <= 0 || st.Truncated {
+		t.Errorf("unexpected state %+v", st)
+	}
+	if st.Pool.Cap != defaultPoolSize {
+		t.Errorf("expected a pool capacity of %d; got %d", defaultPoolSize, st.Pool.Cap)
+	}
+	r := st.Connected[0].Requests[0]
+	if r.Method != Echo || r.Seq == 0 || r.Age <= 0 {
+		t.Errorf("unexpected request state %+v", r)
+	}
+
+	close(stuck)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	st = srv.State()
+	if len(st.Connected) != 1 || len(st.Connected[0].Requests) != 0 {
+		t.Errorf("expected no requests in progress; got %+v", st)
+	}
+}
+
+func TestServerStateDisabled(t *testing.T) {
+	s, c := net.Pipe()
+	go ServeConn(s, EchoHandler{})
+	cl, err := NewClient(c, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cl.Close()
+	if _, err := cl.ServerState(); err != errInvalidCmd {
+		t.Errorf("expected %v; got %v", errInvalidCmd, err)
+	}
+}
+
+func TestServerStateVerified(t *testing.T) {
+	ca := newTestCA(t)
+	srv := NewServer(EchoHandler{}, Introspection(&CertAuth{}))
+
+	s, c := net.Pipe()
+	go srv.ServeConn(tls.Server(s, &tls.Config{
+		Certificates: []tls.Certificate{ca.issue(t, "server")},
+		ClientAuth:   tls.VerifyClientCertIfGiven,
+		ClientCAs:    ca.pool,
+	}))
+	cl, err := NewClient(tls.Client(c, &tls.Config{
+		Certificates: []tls.Certificate{ca.issue(t, "admin")},
+		RootCAs:      ca.pool,
+		ServerName:   "server",
+	}), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cl.Close()
+	if _, err := cl.ServerState(); err != nil {
+		t.Fatal(err)
+	}
+
+	// no certificate
+	s, c = net.Pipe()
+	go srv.ServeConn(s)
+	plain, err := NewClient(c, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plain.Close()
+	if _, err := plain.ServerState(); err != errInvalidCmd {
+		t.Errorf("expected %v; got %v", errInvalidCmd, err)
+	}
+}
+
+func TestServerStateTruncated(t *testing.T) {
+	st := ServerState{Conns: 5000, Connected: make([]ConnState, 5000)}
+	for i := range st.Connected {
+		st.Connected[i].Remote = "10.0.0.1:" + strconv.Itoa(i)
+	}
+	b, err := st.MarshalMsg(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b)+1 > maxMessageSize {
+		t.Fatalf("message is %d bytes", len(b))
+	}
+	var out ServerState
+	if _, err := out.UnmarshalMsg(b); err != nil {
+		t.Fatal(err)
+	}
+	if !out.Truncated || out.Conns != 5000 || len(out.Connected) == 0 || len(out.Connected) >= 5000 {
+		t.Errorf("unexpected state: %d connections of %d, truncated=%v", len(out.Connected), out.Conns, out.Truncated)
+	}
+	if out.Connected[1].Remote != "10.0.0.1:1" {
+		t.Errorf("unexpected remote %q", out.Connected[1].Remote)
+	}
+}
+
+// one busy connection is cut down
+// rather than left out
+func TestServerStateBigConn(t *testing.T) {
+	st := ServerState{Conns: 2, Connected: make([]ConnState, 2)}
+	st.Connected[0].Requests = make([]RequestState, 10000)
+	for i := range st.Connected[0].Requests {
+		st.Connected[0].Requests[i] = RequestState{Seq: uint64(i), Method: Echo, Age: time.Second}
+	}
+	b, err := st.MarshalMsg(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b)+1 > maxMessageSize {
+		t.Fatalf("message is %d bytes", len(b))
+	}
+	var out ServerState
+	if _, err := out.UnmarshalMsg(b); err != nil {
+		t.Fatal(err)
+	}
+	if len(out.Connected) == 0 {
+		t.Fatal("the busy connection was left out")
+	}
+	c := out.Connected[0]
+	if !c.Truncated || len(c.Requests) == 0 || len(c.Requests) >= 10000 {
+		t.Errorf("expected some of the requests; got %d, truncated=%v", len(c.Requests), c.Truncated)
+	}
+	if !out.Truncated {
+		t.Error("expected the second connection to be left out")
+	}
+}
+
+func TestServerStateSize(t *testing.T) {
+	b := msgp.AppendMapHeader(nil, 1)
+	b = msgp.AppendString(b, "connected")
+	b = msgp.AppendArrayHeader(b, 1<<31)
+	var st ServerState
+	if _, err := st.UnmarshalMsg(b); err != msgp.ErrShortBytes {
+		t.Errorf("expected %v; got %v", msgp.ErrShortBytes, err)
+	}
+}
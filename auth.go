@@ -0,0 +1,320 @@
+package synapse
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tinylib/msgp/msgp"
+)
+
+// the metadata key for credentials
+const authKey = "authorization"
+
+// the schemes of the credentials
+// in the authorization metadata
+const (
+	schemeBearer = "Bearer "
+	schemeHMAC   = "HMAC-SHA256 "
+)
+
+var (
+	// ErrNoCredentials is returned by a
+	// Verifier when a request doesn't carry
+	// the kind of credentials that it checks.
+	ErrNoCredentials = errors.New("synapse: no credentials")
+
+	// ErrBadCredentials is returned by a
+	// Verifier when a request carries
+	// credentials that are malformed or
+	// don't check out.
+	ErrBadCredentials = errors.New("synapse: bad credentials")
+)
+
+// Identity is the authenticated
+// identity of a caller.
+type Identity struct {
+	Scheme  string            // "bearer", "hmac" or "tls"
+	Subject string            // the caller's name
+	Cert    *x509.Certificate // the client certificate, for "tls"
+}
+
+// String returns the subject.
+func (i Identity) String() string { return i.Subject }
+
+type identityKey struct{}
+
+// IdentityFromContext returns the
+// identity set by Authenticate.
+func IdentityFromContext(ctx context.Context) (Identity, bool) {
+	id, ok := ctx.Value(identityKey{}).(Identity)
+	return id, ok
+}
+
+// RequestIdentity returns the identity
+// of the caller of a request that
+// passed through Authenticate.
+func RequestIdentity(req Request) (Identity, bool) {
+	return IdentityFromContext(RequestContext(req))
+}
+
+// A Verifier checks the credentials of a
+// request. Verify returns ErrNoCredentials
+// if the request doesn't carry the kind of
+// credentials that it checks. The Request
+// passed to Verify is a RawRequest.
+type Verifier interface {
+	Verify(req Request) (Identity, error)
+}
+
+// Authenticate returns a Middleware that only
+// lets through requests accepted by one of the
+// verifiers, which are tried in order. Other
+// requests are rejected with StatusNotAuthed.
+// The identity of the caller is added to the
+// context of the request; see RequestIdentity.
+// The reason that a request was rejected isn't
+// sent to the client; it is logged to
+// slog.Default() at slog.LevelDebug.
+func Authenticate(v ...Verifier) Middleware {
+	return func(h Handler) Handler {
+		return &authh{inner: h, verifiers: v}
+	}
+}
+
+type authh struct {
+	inner     Handler
+	verifiers []Verifier
+}
+
+// Methods implements MethodLister
+// if the wrapped handler does.
+func (a *authh) Methods() []MethodInfo { return HandlerMethods(a.inner) }
+
+func (a *authh) ServeCall(req Request, res ResponseWriter) {
+	if _, ok := req.(RawRequest); !ok {
+		req = RequestWithContext(req, RequestContext(req))
+	}
+	err := ErrNoCredentials
+	for _, v := range a.verifiers {
+		var id Identity
+		id, err = v.Verify(req)
+		if err == nil {
+			ctx := context.WithValue(RequestContext(req), identityKey{}, id)
+			a.inner.ServeCall(RequestWithContext(req, ctx), res)
+			return
+		}
+		if !errors.Is(err, ErrNoCredentials) {
+			break
+		}
+	}
+	slog.Debug("synapse: request not authenticated",
+		"method", req.Method().String(), "remote", addrString(req), "error", err)
+	res.Error(StatusNotAuthed, "not authenticated")
+}
+
+// BearerAuth is a Verifier for
+// credentials sent with BearerToken.
+type BearerAuth struct {
+	// Tokens returns the subject
+	// that 'token' belongs to, or
+	// false if the token is invalid.
+	Tokens func(token string) (subject string, ok bool)
+}
+
+// Verify implements Verifier
+func (b *BearerAuth) Verify(req Request) (Identity, error) {
+	cred := RequestMetadata(req)[authKey]
+	if !strings.HasPrefix(cred, schemeBearer) {
+		return Identity{}, ErrNoCredentials
+	}
+	sub, ok := b.Tokens(cred[len(schemeBearer):])
+	if !ok {
+		return Identity{}, ErrBadCredentials
+	}
+	return Identity{Scheme: "bearer", Subject: sub}, nil
+}
+
+// HMACAuth is a Verifier for requests
+// signed with HMACSign. The signature
+// covers the method, the body and the time
+// of the call, so a signed request can only
+// be replayed within MaxSkew.
+type HMACAuth struct {
+	// Keys returns the secret key
+	// for a key ID, or false if there
+	// isn't one. The key ID is used as
+	// the subject.
+	Keys func(id string) (key []byte, ok bool)
+
+	// MaxSkew is the maximum difference
+	// between the time that a request was
+	// signed and the time that it is verified.
+	// The default is five minutes.
+	MaxSkew time.Duration
+}
+
+// Verify implements Verifier
+func (h *HMACAuth) Verify(req Request) (Identity, error) {
+	cred := RequestMetadata(req)[authKey]
+	if !strings.HasPrefix(cred, schemeHMAC) {
+		return Identity{}, ErrNoCredentials
+	}
+
+	// the credentials are 'id:time:signature';
+	// the id may contain ':', so they are
+	// split from the right
+	rest := cred[len(schemeHMAC):]
+	i := strings.LastIndexByte(rest, ':')
+	if i < 0 {
+		return Identity{}, ErrBadCredentials
+	}
+	j := strings.LastIndexByte(rest[:i], ':')
+	if j < 0 {
+		return Identity{}, ErrBadCredentials
+	}
+	id := rest[:j]
+	ts, err := strconv.ParseInt(rest[j+1:i], 10, 64)
+	if err != nil {
+		return Identity{}, ErrBadCredentials
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(rest[i+1:])
+	if err != nil {
+		return Identity{}, ErrBadCredentials
+	}
+	skew := h.MaxSkew
+	if skew <= 0 {
+		skew = 5 * time.Minute
+	}
+	if d := time.Since(time.Unix(ts, 0)); d > skew || d < -skew {
+		return Identity{}, ErrBadCredentials
+	}
+	key, ok := h.Keys(id)
+	if !ok {
+		return Identity{}, ErrBadCredentials
+	}
+	body := req.(RawRequest).Body()
+	if !hmac.Equal(sig, signature(key, req.Method(), ts, body)) {
+		return Identity{}, ErrBadCredentials
+	}
+	return Identity{Scheme: "hmac", Subject: id}, nil
+}
+
+// signature computes the HMAC of
+// a call made at time 'ts'
+func signature(key []byte, m Method, ts int64, body []byte) []byte {
+	var buf [12]byte
+	binary.BigEndian.PutUint32(buf[:4], uint32(m))
+	binary.BigEndian.PutUint64(buf[4:], uint64(ts))
+	mac := hmac.New(sha256.New, key)
+	mac.Write(buf[:])
+	mac.Write(body)
+	return mac.Sum(nil)
+}
+
+// CertAuth is a Verifier for the client
+// certificates of TLS connections. The
+// server's tls.Config must verify client
+// certificates (see ServerTLSConfig);
+// unverified certificates are ignored.
+type CertAuth struct {
+	// Subject, if non-nil, returns the
+	// subject for a verified certificate,
+	// and may reject it by returning an
+	// error. By default, the subject is
+	// the one chosen by PeerIdentity.
+	// Certificates with an empty subject
+	// are rejected.
+	Subject func(cert *x509.Certificate) (string, error)
+}
+
+// Verify implements Verifier
+func (c *CertAuth) Verify(req Request) (Identity, error) {
+	id, ok := PeerIdentity(req)
+	if !ok {
+		return Identity{}, ErrNoCredentials
+	}
+	if c.Subject != nil {
+		var err error
+		id.Subject, err = c.Subject(id.Cert)
+		if err != nil {
+			return Identity{}, err
+		}
+	}
+	if id.Subject == "" {
+		return Identity{}, ErrBadCredentials
+	}
+	return id, nil
+}
+
+// RequestTLS returns the state of the
+// TLS connection that a request arrived on,
+// or nil if it didn't arrive over TLS. A
+// Request has TLS state if it has a method
+//
+//  TLS() *tls.ConnectionState
+//
+// The Request passed to handlers by this
+// package has one. The returned state must
+// not be modified.
+func RequestTLS(req Request) *tls.ConnectionState {
+	if r, ok := req.(interface {
+		TLS() *tls.ConnectionState
+	}); ok {
+		return r.TLS()
+	}
+	return nil
+}
+
+// BearerToken makes a client send 'token'
+// with every call, for servers that use
+// BearerAuth. Tokens are sent in the clear,
+// so they should only be used over TLS.
+// BearerToken has no effect on servers.
+func BearerToken(token string) Option {
+	cred := schemeBearer + token
+	return Intercept(func(next Invoker) Invoker {
+		return func(ctx context.Context, method Method, in msgp.Marshaler, out msgp.Unmarshaler) error {
+			ctx = WithMetadata(ctx, Metadata{authKey: cred})
+			return next(ctx, method, in, out)
+		}
+	})
+}
+
+// HMACSign makes a client sign every call
+// with 'key', for servers that use HMACAuth
+// and know the key as 'id'. HMACSign has
+// no effect on servers.
+func HMACSign(id string, key []byte) Option {
+	return Intercept(func(next Invoker) Invoker {
+		return func(ctx context.Context, method Method, in msgp.Marshaler, out msgp.Unmarshaler) error {
+			body, err := encodeBody(in)
+			if err != nil {
+				return err
+			}
+			ts := time.Now().Unix()
+			sig := base64.RawURLEncoding.EncodeToString(signature(key, method, ts, body))
+			cred := schemeHMAC + id + ":" + strconv.FormatInt(ts, 10) + ":" + sig
+			ctx = WithMetadata(ctx, Metadata{authKey: cred})
+			return next(ctx, method, msgp.Raw(body), out)
+		}
+	})
+}
+
+// encodeBody encodes a request body the
+// same way that (*waiter).write does
+func encodeBody(in msgp.Marshaler) ([]byte, error) {
+	if in == nil {
+		return msgp.AppendMapHeader(nil, 0), nil
+	}
+	return in.MarshalMsg(nil)
+}
@@ -0,0 +1,266 @@
+package synapse
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// whoami responds with the
+// subject of the caller
+var whoami = HandlerFunc(func(req Request, res ResponseWriter) {
+	id, ok := RequestIdentity(req)
+	if !ok {
+		res.Error(StatusServerError, "no identity")
+		return
+	}
+	s := testString(id.Scheme + ":" + id.Subject)
+	res.Send(&s)
+})
+
+func authClient(t *testing.T, h Handler, opts ...Option) *Client {
+	srv, cln := net.Pipe()
+	go ServeConn(srv, h)
+	cl, err := NewClient(cln, time.Second, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cl
+}
+
+func expectNotAuthed(t *testing.T, err error) {
+	t.Helper()
+	var re *ResponseError
+	if !errors.As(err, &re) || re.Code != StatusNotAuthed {
+		t.Errorf("expected StatusNotAuthed; got %v", err)
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	h := Authenticate(
+		&BearerAuth{Tokens: func(tok string) (string, bool) {
+			return "alice", tok == "open sesame"
+		}},
+		&HMACAuth{Keys: func(id string) ([]byte, bool) {
+			return []byte("hmac secret"), id == "bob" || id == "svc:bob"
+		}},
+	)(whoami)
+
+	for _, c := range []struct {
+		opt  Option
+		want string
+	}{
+		{BearerToken("open sesame"), "bearer:alice"},
+		{HMACSign("bob", []byte("hmac secret")), "hmac:bob"},
+		{HMACSign("svc:bob", []byte("hmac secret")), "hmac:svc:bob"},
+	} {
+		cl := authClient(t, h, c.opt)
+		var out testString
+		if err := cl.Call(Echo, nil, &out); err != nil {
+			t.Fatal(err)
+		}
+		if string(out) != c.want {
+			t.Errorf("expected %q; got %q", c.want, out)
+		}
+		// a body, for the signature
+		in := testString("signed")
+		if err := cl.Call(Echo, &in, &out); err != nil {
+			t.Fatal(err)
+		}
+		cl.Close()
+	}
+
+	for _, opt := range []Option{
+		BearerToken("wrong"),
+		HMACSign("bob", []byte("wrong")),
+		HMACSign("eve", []byte("hmac secret")),
+		PoolSize(1), // no credentials
+	} {
+		cl := authClient(t, h, opt)
+		expectNotAuthed(t, cl.Call(Echo, nil, nil))
+		cl.Close()
+	}
+}
+
+// noCreds wraps ErrNoCredentials
+type noCreds struct{}
+
+func (noCreds) Verify(Request) (Identity, error) {
+	return Identity{}, fmt.Errorf("no header: %w", ErrNoCredentials)
+}
+
+// secretErr rejects every request with
+// an error that shouldn't reach clients
+type secretErr struct{}
+
+func (secretErr) Verify(Request) (Identity, error) {
+	return Identity{}, errors.New("key 42 revoked by admin")
+}
+
+func TestAuthenticateErrors(t *testing.T) {
+	// a wrapped ErrNoCredentials
+	// moves on to the next verifier
+	bearer := &BearerAuth{Tokens: func(tok string) (string, bool) { return "alice", true }}
+	cl := authClient(t, Authenticate(noCreds{}, bearer)(whoami), BearerToken("x"))
+	if err := cl.Call(Echo, nil, nil); err != nil {
+		t.Error(err)
+	}
+	cl.Close()
+
+	cl = authClient(t, Authenticate(secretErr{})(whoami))
+	err := cl.Call(Echo, nil, nil)
+	expectNotAuthed(t, err)
+	if strings.Contains(err.Error(), "revoked") {
+		t.Errorf("verifier error sent to the client: %v", err)
+	}
+	cl.Close()
+}
+
+func TestHMACSkew(t *testing.T) {
+	key := []byte("k")
+	a := &HMACAuth{Keys: func(string) ([]byte, bool) { return key, true }, MaxSkew: time.Minute}
+	body := []byte{0x80}
+	old := time.Now().Add(-time.Hour).Unix()
+	cred := schemeHMAC + "x:" + strconv.FormatInt(old, 10) + ":" + base64.RawURLEncoding.EncodeToString(signature(key, Echo, old, body))
+	req := &mockReq{mtd: Echo, raw: body, md: Metadata{authKey: cred}}
+	if _, err := a.Verify(req); err != ErrBadCredentials {
+		t.Errorf("expected ErrBadCredentials for an old signature; got %v", err)
+	}
+}
+
+// testCA issues certificates for tests
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pool *x509.CertPool
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &testCA{cert: cert, key: key, pool: pool}
+}
+
+// issue returns a certificate for 'name'
+// that is valid for clients and servers
+func (ca *testCA) issue(t *testing.T, name string) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, _ := x509.ParseCertificate(der)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func TestCertAuth(t *testing.T) {
+	ca := newTestCA(t)
+	h := Authenticate(&CertAuth{})(whoami)
+
+	srv, cln := net.Pipe()
+	go ServeConn(tls.Server(srv, &tls.Config{
+		Certificates: []tls.Certificate{ca.issue(t, "server")},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    ca.pool,
+	}), h)
+	cl, err := NewClient(tls.Client(cln, &tls.Config{
+		Certificates: []tls.Certificate{ca.issue(t, "carol")},
+		RootCAs:      ca.pool,
+		ServerName:   "server",
+	}), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cl.Close()
+
+	var out testString
+	if err := cl.Call(Echo, nil, &out); err != nil {
+		t.Fatal(err)
+	}
+	if out != "tls:carol" {
+		t.Errorf("expected tls:carol; got %q", out)
+	}
+
+	// no TLS
+	plain := authClient(t, h)
+	defer plain.Close()
+	expectNotAuthed(t, plain.Call(Echo, nil, nil))
+}
+
+func TestCertAuthSubject(t *testing.T) {
+	uri, _ := url.Parse("spiffe://example.org/svc")
+	for _, c := range []struct {
+		cert *x509.Certificate
+		want string
+	}{
+		{&x509.Certificate{Subject: pkix.Name{CommonName: "cn"}, DNSNames: []string{"dns"}}, "cn"},
+		{&x509.Certificate{URIs: []*url.URL{uri}, EmailAddresses: []string{"a@b"}, DNSNames: []string{"dns"}}, uri.String()},
+		{&x509.Certificate{EmailAddresses: []string{"a@b"}, DNSNames: []string{"dns"}}, "a@b"},
+		{&x509.Certificate{DNSNames: []string{"dns"}}, "dns"},
+		{&x509.Certificate{}, ""},
+	} {
+		req := &mockReq{tls: &tls.ConnectionState{
+			VerifiedChains: [][]*x509.Certificate{{c.cert}},
+		}}
+		id, err := (&CertAuth{}).Verify(req)
+		if c.want == "" {
+			if err != ErrBadCredentials {
+				t.Errorf("expected ErrBadCredentials for an empty subject; got %v", err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id.Subject != c.want {
+			t.Errorf("expected subject %q; got %q", c.want, id.Subject)
+		}
+	}
+}
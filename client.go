@@ -1,6 +1,7 @@
 package synapse
 
 import (
+	"context"
 	"crypto/tls"
 	"errors"
 	"fmt"
@@ -32,8 +33,7 @@ var (
 
 	// ErrTimeout is returned when a server
 	// doesn't respond to a request before
-	// the client's timeout scavenger can
-	// free the waiting goroutine
+	// its deadline
 	ErrTimeout = errors.New("synapse: the server didn't respond in time")
 
 	// ErrTooLarge is returned when the message
@@ -45,47 +45,62 @@ var (
 // the provided network and remote address.
 // The provided timeout is used as the timeout
 // for requests, in milliseconds.
-func Dial(network string, raddr string, timeout time.Duration) (*Client, error) {
+func Dial(network string, raddr string, timeout time.Duration, opts ...Option) (*Client, error) {
 	conn, err := net.Dial(network, raddr)
 	if err != nil {
 		return nil, err
 	}
-	return NewClient(conn, timeout)
+	return NewClient(conn, timeout, opts...)
 }
 
 // DialTLS acts identically to Dial, except that it dials the connection
 // over TLS using the provided *tls.Config.
-func DialTLS(network, raddr string, timeout time.Duration, config *tls.Config) (*Client, error) {
+func DialTLS(network, raddr string, timeout time.Duration, config *tls.Config, opts ...Option) (*Client, error) {
 	conn, err := tls.Dial(network, raddr, config)
 	if err != nil {
 		return nil, err
 	}
-	return NewClient(conn, timeout)
+	return NewClient(conn, timeout, opts...)
 }
 
 // NewClient creates a new client from an
 // existing net.Conn. Timeout is the maximum time,
 // in milliseconds, to wait for server responses
 // before sending an error to the caller. NewClient
-// fails with an error if it cannot ping the server
-// over the connection.
-func NewClient(c net.Conn, timeout time.Duration) (*Client, error) {
+// fails with an error if it cannot complete a
+// handshake with the server over the connection.
+func NewClient(c net.Conn, timeout time.Duration, opts ...Option) (*Client, error) {
 	cl := &Client{
 		conn:    c,
 		writing: make(chan *waiter, waiterHWM),
 		done:    make(chan struct{}),
 		state:   clientOpen,
+		timeout: timeout,
 	}
+	cl.deadlines.init()
+	cl.cfg.apply(opts)
+	cl.cfg.metrics.connOpened(sideClient)
+	cl.invoker = cl.chain()
+	cl.waiters.init(cl.cfg.pool())
+	cl.last = time.Now().UnixNano()
 	go cl.readLoop()
-	go cl.writeLoop()
-	go cl.timeoutLoop(timeout)
+	if cl.cfg.vector > 0 {
+		go cl.writeLoopv()
+	} else {
+		go cl.writeLoop()
+	}
+	go cl.timeoutLoop()
 
-	// do a ping to check
-	// for sanity
-	err := cl.ping()
+	// do a handshake to check
+	// for sanity and learn about
+	// the server
+	err := cl.handshake()
 	if err != nil {
 		cl.Close()
-		return nil, fmt.Errorf("synapse: ping failed: %s", err)
+		return nil, fmt.Errorf("synapse: handshake failed: %s", err)
+	}
+	if cl.cfg.keepalive > 0 {
+		go cl.keepaliveLoop()
 	}
 
 	return cl, nil
@@ -94,27 +109,50 @@ func NewClient(c net.Conn, timeout time.Duration) (*Client, error) {
 // Client is a client to
 // a single synapse server.
 type Client struct {
-	conn    net.Conn       // connection
-	wlock   sync.Mutex     // write lock
-	csn     uint64         // sequence number; atomic
-	writing chan *waiter   // queue to write to conn; size is effectively HWM
-	done    chan struct{}  // closed during (*Client).Close to shut down timeoutloop
-	wg      sync.WaitGroup // outstanding client procs
-	state   uint32         // open, closed, etc.
-	pending wMap           // map seq number to waiting handler
+	conn      net.Conn       // connection
+	wlock     sync.Mutex     // write lock
+	csn       uint64         // sequence number; atomic
+	writing   chan *waiter   // queue to write to conn; size is effectively HWM
+	done      chan struct{}  // closed during (*Client).Close to shut down timeoutloop
+	timeout   time.Duration  // default timeout for calls
+	deadlines deadlines      // call timeouts
+	wg        sync.WaitGroup // outstanding client procs
+	state     uint32         // open, closed, etc.
+	pending   wMap           // map seq number to waiting handler
+	cfg       config         // options
+	peer      PeerInfo       // server's handshake
+	feats     Features       // negotiated features
+	last      int64          // time of last read, in unix nanoseconds; atomic
+	rtt       int64          // last keepalive round-trip time; atomic
+	waiters   waitStack      // pool of *waiter
+	invoker   Invoker        // interceptor chain; nil if there are no interceptors
 }
 
 // used to transfer control
 // flow to blocking goroutines
 type waiter struct {
-	next   *waiter    // next in linked list, or nil
-	parent *Client    // parent *client
-	seq    uint64     // sequence number
-	done   sema.Point // for notifying response
-	err    error      // response error on wakeup, if applicable
-	in     []byte     // response body
-	reap   bool       // can reap for timeout
-	static bool       // is part of the statically allocated arena
+	next     *waiter    // next in linked list, or nil
+	parent   *Client    // parent *client
+	seq      uint64     // sequence number
+	done     sema.Point // for notifying response
+	err      error      // response error on wakeup, if applicable
+	in       []byte     // response body
+	z        []byte     // compression scratch space
+	deadline int64      // timeout, in unix nanoseconds
+	hidx     int        // position in the deadline heap; see waitHeap
+	refs     int32      // references held by the caller and the write loop; see unref
+}
+
+// unref drops a reference to a waiter and
+// returns it to the pool once nothing else
+// refers to it. the caller holds one reference,
+// and the write loop holds another from the
+// time the waiter is queued until its frame
+// is written.
+func (c *Client) unref(w *waiter) {
+	if atomic.AddInt32(&w.refs, -1) == 0 {
+		c.waiters.push(w)
+	}
 }
 
 // Close idempotently closes the
@@ -128,6 +166,7 @@ func (c *Client) Close() error {
 	if !atomic.CompareAndSwapUint32(&c.state, clientOpen, clientClosed) {
 		return ErrClosed
 	}
+	c.cfg.metrics.connClosed(sideClient)
 
 	c.wg.Wait()
 	close(c.done)
@@ -142,11 +181,13 @@ func (c *Client) closeError(err error) {
 	if !atomic.CompareAndSwapUint32(&c.state, clientOpen, clientClosed) {
 		return
 	}
+	c.cfg.metrics.connClosed(sideClient)
 
-	err = fmt.Errorf("synapse: fatal error: %s", err)
+	err = fmt.Errorf("synapse: fatal error: %w", err)
 
 	// we can't actually guarantee that we will preempt
 	// every goroutine, but we can try.
+	c.deadlines.clear()
 	c.pending.flush(err)
 	for c.pending.length() > 0 {
 		c.pending.flush(err)
@@ -180,6 +221,7 @@ func (c *Client) readLoop() {
 	var sz int
 	var frame fType
 	var lead [leadSize]byte
+	var zbuf []byte // compressed bodies
 	bwr := fwd.NewReaderSize(c.conn, 4096)
 
 	for {
@@ -188,6 +230,18 @@ func (c *Client) readLoop() {
 		}
 
 		seq, frame, sz = readFrame(lead)
+		compressed := frame&fCompressed != 0
+		frame &^= fCompressed
+		atomic.StoreInt64(&c.last, time.Now().UnixNano())
+		c.cfg.metrics.read(sideClient, leadSize+sz)
+
+		if frame == fPING {
+			if !c.do(bwr.Skip(sz)) {
+				return
+			}
+			c.pong(seq)
+			continue
+		}
 
 		// only accept fCMD and fRES frames;
 		// they are routed to waiters
@@ -207,9 +261,24 @@ func (c *Client) readLoop() {
 			}
 			continue
 		}
+		c.deadlines.remove(w)
 
 		// fill the waiters input
 		// buffer and then notify
+		if compressed {
+			if cap(zbuf) >= sz {
+				zbuf = zbuf[:sz]
+			} else {
+				zbuf = make([]byte, sz)
+			}
+			if !c.do(bwr.ReadFull(zbuf)) {
+				return
+			}
+			w.in, w.err = inflate(w.in, zbuf)
+			sema.Wake(&w.done)
+			continue
+		}
+
 		if cap(w.in) >= sz {
 			w.in = w.in[:sz]
 		} else {
@@ -228,25 +297,6 @@ func (c *Client) readLoop() {
 	}
 }
 
-// once every 'msec' milliseconds, reap
-// every pending item with reap=true, and
-// set all others to reap=true.
-//
-// NOTE(pmh): this doesn't actually guarantee
-// de-queing after the given duration;
-// rather, it limits max wait time to 2*msec.
-func (c *Client) timeoutLoop(d time.Duration) {
-	tick := time.Tick(d)
-	for {
-		select {
-		case <-c.done:
-			return
-		case <-tick:
-			c.pending.reap()
-		}
-	}
-}
-
 func (c *Client) writeLoop() {
 	bwr := fwd.NewWriterSize(c.conn, 4096)
 
@@ -261,6 +311,7 @@ func (c *Client) writeLoop() {
 		if !c.do(bwr.Write(wt.in)) {
 			return
 		}
+		c.unref(wt)
 	more:
 		select {
 		case another, ok := <-c.writing:
@@ -268,6 +319,7 @@ func (c *Client) writeLoop() {
 				if !c.do(bwr.Write(another.in)) {
 					return
 				}
+				c.unref(another)
 				goto more
 			} else {
 				bwr.Flush()
@@ -283,7 +335,7 @@ func (c *Client) writeLoop() {
 
 // write a command to the connection - works
 // similarly to standard write()
-func (w *waiter) writeCommand(cmd command, msg []byte) error {
+func (w *waiter) writeCommand(cmd command, msg []byte, timeout time.Duration) error {
 	w.parent.wg.Add(1)
 	if atomic.LoadUint32(&w.parent.state) == clientClosed {
 		return ErrClosed
@@ -306,19 +358,27 @@ func (w *waiter) writeCommand(cmd command, msg []byte) error {
 	w.in[leadSize] = byte(cmd)
 	copy(w.in[leadSize+1:], msg)
 
-	w.writebody(seqn)
+	w.writebody(seqn, timeout)
 	return nil
 }
 
-func (w *waiter) writebody(seq uint64) {
+func (w *waiter) writebody(seq uint64, timeout time.Duration) {
 	w.seq = seq
-	w.reap = false
 	p := w.parent
 	p.pending.insert(w)
+	// the deadline has to be set after the
+	// waiter is in the map, and before the
+	// request can possibly be answered
+	if timeout > 0 {
+		w.deadline = time.Now().Add(timeout).UnixNano()
+		p.deadlines.add(w)
+	}
+	p.cfg.metrics.wrote(sideClient, len(w.in))
+	atomic.AddInt32(&w.refs, 1)
 	p.writing <- w
 }
 
-func (w *waiter) write(method Method, in msgp.Marshaler) error {
+func (w *waiter) write(method Method, in msgp.Marshaler, md Metadata, timeout time.Duration) error {
 	w.parent.wg.Add(1)
 	if atomic.LoadUint32(&w.parent.state) == clientClosed {
 		return ErrClosed
@@ -334,6 +394,13 @@ func (w *waiter) write(method Method, in msgp.Marshaler) error {
 		w.in = w.in[:leadSize]
 	}
 
+	var flag fType
+	p := w.parent
+	if len(md) > 0 && p.feats.Has(FeatureHeaders) {
+		w.in = appendMetadata(w.in, md)
+		flag = fMetadata
+	}
+
 	// write body
 	w.in = msgp.AppendUint32(w.in, uint32(method))
 	// handle nil body
@@ -346,6 +413,12 @@ func (w *waiter) write(method Method, in msgp.Marshaler) error {
 		w.in = msgp.AppendMapHeader(w.in, 0)
 	}
 
+	if p.feats.Has(FeatureCompression) {
+		var zflag fType
+		w.in, w.z, zflag = compressFrame(w.in, w.z, p.cfg.threshold)
+		flag |= zflag
+	}
+
 	// raw request body
 	olen := len(w.in) - leadSize
 
@@ -353,9 +426,9 @@ func (w *waiter) write(method Method, in msgp.Marshaler) error {
 		return ErrTooLarge
 	}
 
-	putFrame(w.in, sn, fREQ, olen)
+	putFrame(w.in, sn, fREQ|flag, olen)
 
-	w.writebody(sn)
+	w.writebody(sn, timeout)
 	return nil
 }
 
@@ -365,11 +438,7 @@ func (w *waiter) read(out msgp.Unmarshaler) error {
 		return err
 	}
 	if Status(code) != StatusOK {
-		str, _, err := msgp.ReadStringBytes(w.in)
-		if err != nil {
-			str = "<?>"
-		}
-		return &ResponseError{Code: Status(code), Expl: str}
+		return readError(Status(code), body)
 	}
 	if out != nil {
 		_, err = out.UnmarshalMsg(body)
@@ -377,31 +446,119 @@ func (w *waiter) read(out msgp.Unmarshaler) error {
 	return err
 }
 
-func (w *waiter) call(method Method, in msgp.Marshaler, out msgp.Unmarshaler) error {
-	err := w.write(method, in)
+func (w *waiter) call(ctx context.Context, method Method, in msgp.Marshaler, out msgp.Unmarshaler, timeout time.Duration) error {
+	p := w.parent
+	err := w.write(method, in, MetadataFromContext(ctx), timeout)
 	if err != nil {
-		w.parent.wg.Done()
+		p.wg.Done()
 		return err
 	}
 	// wait for response
-	sema.Wait(&w.done)
-	w.parent.wg.Done()
+	if ctx.Done() != nil {
+		seq := w.seq
+		stop := context.AfterFunc(ctx, func() { p.cancel(seq, ctx.Err()) })
+		sema.Wait(&w.done)
+		stop()
+	} else {
+		sema.Wait(&w.done)
+	}
+	p.wg.Done()
 	if w.err != nil {
 		return w.err
 	}
 	return w.read(out)
 }
 
+// CallError is the type of error returned by
+// (*Client).Call when a call fails for any
+// reason other than an error response from
+// the server, which is returned as a *ResponseError.
+// It wraps the underlying error, so, for example,
+// errors.Is(err, ErrTimeout) reports whether or
+// not the call timed out.
+type CallError struct {
+	Method  Method        // method called
+	Addr    net.Addr      // remote address
+	Seq     uint64        // sequence number; 0 if the request wasn't sent
+	Elapsed time.Duration // time between the call and the failure
+	Err     error         // underlying error
+}
+
+// Error implements error
+func (e *CallError) Error() string {
+	return fmt.Sprintf("synapse: call to %s (seq %d) at %s failed after %s: %s", e.Method, e.Seq, e.Addr, e.Elapsed, e.Err)
+}
+
+// Unwrap returns the underlying error
+func (e *CallError) Unwrap() error { return e.Err }
+
 // Call sends a request to the server with 'in' as the body,
 // and then decodes the response into 'out'. Call is safe
 // to call from multiple goroutines simultaneously.
 func (c *Client) Call(method Method, in msgp.Marshaler, out msgp.Unmarshaler) error {
-	w := waiters.pop(c)
-	err := w.call(method, in, out)
-	waiters.push(w)
+	return c.CallTimeout(method, in, out, c.timeout)
+}
+
+// CallContext is like Call, but it sends the
+// metadata in 'ctx' (see WithMetadata), uses
+// the deadline of 'ctx' as the timeout if it
+// has one, and fails with the error from 'ctx'
+// if it is cancelled before the call completes.
+func (c *Client) CallContext(ctx context.Context, method Method, in msgp.Marshaler, out msgp.Unmarshaler) error {
+	if c.invoker != nil {
+		return c.invoker(ctx, method, in, out)
+	}
+	return c.invoke(ctx, method, in, out)
+}
+
+// CallTimeout is like Call, but it uses the provided
+// timeout instead of the client's default. A timeout
+// of 0 or less means that the call never times out.
+func (c *Client) CallTimeout(method Method, in msgp.Marshaler, out msgp.Unmarshaler, timeout time.Duration) error {
+	if c.invoker != nil {
+		ctx := context.WithValue(context.Background(), timeoutKey{}, timeout)
+		return c.invoker(ctx, method, in, out)
+	}
+	return c.call(context.Background(), method, in, out, timeout)
+}
+
+func (c *Client) call(ctx context.Context, method Method, in msgp.Marshaler, out msgp.Unmarshaler, timeout time.Duration) error {
+	w := c.waiters.pop(c)
+	w.seq = 0
+	start := time.Now()
+	c.cfg.metrics.start(sideClient)
+	err := w.call(ctx, method, in, out, timeout)
+	if m := c.cfg.metrics; m != nil {
+		m.finish(sideClient, method, callStatus(err), time.Since(start))
+		if errors.Is(err, ErrTimeout) {
+			m.timeout(sideClient)
+		}
+	}
+	if err != nil {
+		if _, ok := err.(*ResponseError); !ok {
+			err = &CallError{
+				Method:  method,
+				Addr:    c.conn.RemoteAddr(),
+				Seq:     w.seq,
+				Elapsed: time.Since(start),
+				Err:     err,
+			}
+		}
+	}
+	c.unref(w)
 	return err
 }
 
+// cancel fails a pending call
+// whose context was cancelled
+func (c *Client) cancel(seq uint64, err error) {
+	if w := c.pending.remove(seq); w != nil {
+		c.deadlines.remove(w)
+		w.err = err
+		sema.Wake(&w.done)
+	}
+}
+
 // errors specific to commands
 var (
 	errNoCmd      = errors.New("synapse: no response CMD code")
@@ -409,12 +566,22 @@ var (
 	errUnknownCmd = errors.New("synapse: unknown command")
 )
 
-// doCommand executes a command from the client
-func (c *Client) sendCommand(cmd command, msg []byte) error {
-	w := waiters.pop(c)
-	err := w.writeCommand(cmd, msg)
+// sendCommand executes a command from the client.
+// if 'out' is non-nil, the body of the response
+// is decoded into it.
+func (c *Client) sendCommand(cmd command, msg []byte, out msgp.Unmarshaler) error {
+	return c.sendCommandTimeout(cmd, msg, out, c.timeout)
+}
+
+// sendCommandTimeout is sendCommand
+// with a timeout other than the
+// client's default
+func (c *Client) sendCommandTimeout(cmd command, msg []byte, out msgp.Unmarshaler, timeout time.Duration) error {
+	w := c.waiters.pop(c)
+	err := w.writeCommand(cmd, msg, timeout)
 	if err != nil {
 		c.wg.Done()
+		c.unref(w)
 		return err
 	}
 
@@ -422,36 +589,51 @@ func (c *Client) sendCommand(cmd command, msg []byte) error {
 	sema.Wait(&w.done)
 	c.wg.Done()
 	if w.err != nil {
-		return w.err
+		err = w.err
+		c.unref(w)
+		return err
 	}
 
 	// bad response
 	if len(w.in) == 0 {
-		waiters.push(w)
+		c.unref(w)
 		return errNoCmd
 	}
 
 	ret := command(w.in[0])
 
 	if ret == cmdInvalid || ret >= _maxcommand {
-		waiters.push(w)
+		c.unref(w)
 		return errInvalidCmd
 	}
 
 	act := cmdDirectory[ret]
 	if act == nil {
-		waiters.push(w)
+		c.unref(w)
 		return errUnknownCmd
 	}
 
 	act.Client(c, w.in[1:])
-	waiters.push(w)
-	return nil
+	if out != nil {
+		_, err = out.UnmarshalMsg(w.in[1:])
+	}
+	c.unref(w)
+	return err
 }
 
 // perform the ping command;
 // returns an error if the server
 // didn't respond appropriately
 func (c *Client) ping() error {
-	return c.sendCommand(cmdPing, nil)
+	return c.sendCommand(cmdPing, nil, nil)
+}
+
+// Methods asks the server for the list
+// of methods exposed by its Handler.
+// The list is empty if the server's handler
+// doesn't implement MethodLister.
+func (c *Client) Methods() ([]MethodInfo, error) {
+	var l methodList
+	err := c.sendCommand(cmdListMethods, nil, &l)
+	return []MethodInfo(l), err
 }
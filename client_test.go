@@ -2,10 +2,14 @@ package synapse
 
 import (
 	"bytes"
+	"errors"
+	"io"
 	"net"
 	"sync"
 	"testing"
 	"time"
+
+	"github.com/tinylib/msgp/msgp"
 )
 
 func isCode(err error, c Status) bool {
@@ -70,8 +74,149 @@ func TestNop(t *testing.T) {
 	}
 }
 
+func TestCallError(t *testing.T) {
+	srv, cln := net.Pipe()
+	hang := HandlerFunc(func(req Request, res ResponseWriter) {
+		time.Sleep(50 * time.Millisecond)
+		res.Send(nil)
+	})
+	go ServeConn(srv, hang)
+	cl, err := NewClient(cln, 5*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cl.Close()
+
+	err = cl.Call(Echo, nil, nil)
+	if !errors.Is(err, ErrTimeout) {
+		t.Fatalf("expected a timeout; got %v", err)
+	}
+	var ce *CallError
+	if !errors.As(err, &ce) {
+		t.Fatalf("expected a *CallError; got %#v", err)
+	}
+	if ce.Method != Echo || ce.Seq == 0 || ce.Elapsed < 5*time.Millisecond || ce.Addr == nil {
+		t.Errorf("unexpected call error: %#v", ce)
+	}
+}
+
+func TestErrorDetails(t *testing.T) {
+	err := tcpClient.Call(Fail, nil, nil)
+	var re *ResponseError
+	if !errors.As(err, &re) {
+		t.Fatalf("expected a *ResponseError; got %#v", err)
+	}
+	if re.Code != StatusServerError || re.Expl != "try again later" {
+		t.Errorf("unexpected code and explanation: %s, %q", re.Code, re.Expl)
+	}
+	if re.AppCode != 42 || !re.Retryable || re.RetryAfter != time.Second {
+		t.Errorf("unexpected details: %#v", re)
+	}
+	var details String
+	_, err = details.UnmarshalMsg(re.Details)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if details != "some details" {
+		t.Errorf("expected details %q; got %q", "some details", details)
+	}
+
+	// errors without details
+	err = tcpClient.Call(100, nil, nil)
+	if !errors.As(err, &re) {
+		t.Fatalf("expected a *ResponseError; got %#v", err)
+	}
+	if re.Expl != "no such method" || re.hasDetails() {
+		t.Errorf("unexpected error: %#v", re)
+	}
+}
+
+func TestMethods(t *testing.T) {
+	ms, err := tcpClient.Methods()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ms) != len(*rt) {
+		t.Fatalf("expected %d methods; got %d", len(*rt), len(ms))
+	}
+	for _, m := range ms {
+		if m.Name != m.ID.String() {
+			t.Errorf("method %d: expected name %q; got %q", m.ID, m.ID.String(), m.Name)
+		}
+	}
+}
+
+func TestMethodListSize(t *testing.T) {
+	// an array header claiming 2^32-1
+	// entries, with nothing after it
+	b := msgp.AppendArrayHeader(nil, 1<<32-1)
+	var l methodList
+	if _, err := l.UnmarshalMsg(b); err != msgp.ErrShortBytes {
+		t.Errorf("expected ErrShortBytes; got %v", err)
+	}
+}
+
+func TestHandshake(t *testing.T) {
+	p := tcpClient.Peer()
+	if p.Version != ProtocolVersion {
+		t.Errorf("expected server version %d; got %d", ProtocolVersion, p.Version)
+	}
+	if p.MaxMessageSize != maxMessageSize {
+		t.Errorf("expected max message size %d; got %d", maxMessageSize, p.MaxMessageSize)
+	}
+	if p.Frames&(1<<fREQ) == 0 {
+		t.Error("server should support request frames")
+	}
+}
+
+// oldServer answers pings the way servers
+// that predate the handshake do, and
+// ignores every other command
+func oldServer(c net.Conn) {
+	defer c.Close()
+	var lead [leadSize]byte
+	for {
+		if _, err := io.ReadFull(c, lead[:]); err != nil {
+			return
+		}
+		seq, ft, sz := readFrame(lead)
+		body := make([]byte, sz)
+		if _, err := io.ReadFull(c, body); err != nil {
+			return
+		}
+		if ft != fCMD || sz == 0 || command(body[0]) != cmdPing {
+			continue
+		}
+		out := make([]byte, leadSize+1)
+		putFrame(out, seq, fCMD, 1)
+		out[leadSize] = byte(cmdPing)
+		if _, err := c.Write(out); err != nil {
+			return
+		}
+	}
+}
+
+func TestHandshakeOldServer(t *testing.T) {
+	srv, cln := net.Pipe()
+	go oldServer(srv)
+	cl, err := NewClient(cln, 50*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cl.Close()
+	if v := cl.Peer().Version; v != 0 {
+		t.Errorf("expected server version 0; got %d", v)
+	}
+}
+
 // benchmarks the test case above
-func BenchmarkTCPEcho(b *testing.B) {
+func BenchmarkTCPEcho(b *testing.B) { benchTCPEcho(b) }
+
+func BenchmarkTCPEchoWorkers(b *testing.B) { benchTCPEcho(b, Execution(WorkerPool, 0)) }
+
+func BenchmarkTCPEchoInline(b *testing.B) { benchTCPEcho(b, Execution(Inline, 0)) }
+
+func benchTCPEcho(b *testing.B, opts ...Option) {
 	l, err := net.Listen("tcp", "localhost:7000")
 	if err != nil {
 		b.Fatal(err)
@@ -81,7 +226,7 @@ func BenchmarkTCPEcho(b *testing.B) {
 		time.Sleep(1 * time.Millisecond)
 	}()
 
-	go Serve(l, EchoHandler{})
+	go Serve(l, EchoHandler{}, opts...)
 	cl, err := Dial("tcp", "localhost:7000", 50*time.Millisecond)
 	if err != nil {
 		b.Fatal(err)
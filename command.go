@@ -28,6 +28,14 @@ const (
 
 	// command frame
 	fCMD
+
+	// keepalive ping frame;
+	// sent by the server
+	fPING
+
+	// keepalive ping
+	// response frame
+	fPONG
 )
 
 // command is a message
@@ -41,7 +49,10 @@ type command uint8
 // cmdDirectory is a map of all the commands
 // to their respective actions
 var cmdDirectory = [_maxcommand]action{
-	cmdPing: ping{},
+	cmdPing:        ping{},
+	cmdListMethods: listMethods{},
+	cmdHello:       hello{},
+	cmdState:       getState{},
 }
 
 // an action is the consequence
@@ -72,6 +83,20 @@ const (
 	// command
 	cmdPing
 
+	// list the methods
+	// exposed by the
+	// server's handler
+	cmdListMethods
+
+	// handshake; exchanges
+	// PeerInfo
+	cmdHello
+
+	// report the server's
+	// live state; see
+	// Introspection
+	cmdState
+
 	// a command >= _maxcommand
 	// is invalid
 	_maxcommand
@@ -83,3 +108,20 @@ type ping struct{}
 func (p ping) Client(cl *Client, res []byte) {}
 
 func (p ping) Server(ch *connHandler, body []byte) ([]byte, error) { return nil, nil }
+
+// listMethods returns the methods
+// exposed by the server's handler
+type listMethods struct{}
+
+func (l listMethods) Client(cl *Client, res []byte) {}
+
+func (l listMethods) Server(ch *connHandler, body []byte) ([]byte, error) {
+	out, err := methodList(HandlerMethods(ch.h)).MarshalMsg(nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(out)+1 > maxMessageSize {
+		return nil, ErrTooLarge
+	}
+	return out, nil
+}
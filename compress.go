@@ -0,0 +1,127 @@
+package synapse
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"io"
+	"sync"
+)
+
+const (
+	// fCompressed is set in the frame
+	// type of frames whose body is
+	// compressed with DEFLATE (RFC 1951)
+	fCompressed fType = 0x80
+
+	// default value for the
+	// compression threshold
+	defaultThreshold = 512
+
+	// maxInflatedSize is the largest a
+	// message body can be once decompressed
+	maxInflatedSize = 16 * maxMessageSize
+)
+
+// errInflatedSize is returned when a compressed
+// body decompresses to more than maxInflatedSize
+var errInflatedSize = errors.New("synapse: decompressed message body too large")
+
+// Compression enables compression of message
+// bodies on connections where the other end
+// also supports it. Bodies of at least 'threshold'
+// bytes are compressed, provided that the result
+// is smaller than the original. A threshold of 0
+// or less selects a default value.
+//
+// With compression, the 65,535-byte size limit
+// applies to the compressed body, so larger
+// messages can be sent as long as they compress
+// well enough.
+func Compression(threshold int) Option {
+	return func(c *config) {
+		if threshold <= 0 {
+			threshold = defaultThreshold
+		}
+		c.features |= FeatureCompression
+		c.threshold = threshold
+	}
+}
+
+var (
+	flateWriters = sync.Pool{
+		New: func() interface{} {
+			w, _ := flate.NewWriter(nil, flate.BestSpeed)
+			return w
+		},
+	}
+	flateReaders sync.Pool
+)
+
+// appendWriter is an io.Writer
+// that appends to a slice
+type appendWriter struct {
+	b []byte
+}
+
+func (a *appendWriter) Write(p []byte) (int, error) {
+	a.b = append(a.b, p...)
+	return len(p), nil
+}
+
+// deflate appends the compressed
+// form of 'src' to 'dst'
+func deflate(dst []byte, src []byte) []byte {
+	aw := appendWriter{b: dst}
+	fw := flateWriters.Get().(*flate.Writer)
+	fw.Reset(&aw)
+	fw.Write(src)
+	fw.Close()
+	flateWriters.Put(fw)
+	return aw.b
+}
+
+// inflate decompresses 'src' into 'dst',
+// re-using its storage if possible. it fails
+// if the output is larger than maxInflatedSize.
+func inflate(dst []byte, src []byte) ([]byte, error) {
+	var fr io.ReadCloser
+	br := bytes.NewReader(src)
+	if r := flateReaders.Get(); r != nil {
+		fr = r.(io.ReadCloser)
+		fr.(flate.Resetter).Reset(br, nil)
+	} else {
+		fr = flate.NewReader(br)
+	}
+	buf := bytes.NewBuffer(dst[:0])
+	n, err := buf.ReadFrom(io.LimitReader(fr, maxInflatedSize+1))
+	fr.Close()
+	flateReaders.Put(fr)
+	if err != nil {
+		return dst, err
+	}
+	if n > maxInflatedSize {
+		return dst, errInflatedSize
+	}
+	return buf.Bytes(), nil
+}
+
+// compressFrame compresses the body of the
+// framed message in 'msg' into 'scratch' if
+// it is at least 'threshold' bytes and the
+// result is smaller. it returns the message to
+// send, the spare buffer, and the frame type
+// flag to set.
+func compressFrame(msg []byte, scratch []byte, threshold int) (out []byte, spare []byte, flag fType) {
+	if len(msg)-leadSize < threshold {
+		return msg, scratch, 0
+	}
+	if cap(scratch) < leadSize {
+		scratch = make([]byte, leadSize, len(msg))
+	}
+	z := deflate(scratch[:leadSize], msg[leadSize:])
+	if len(z) >= len(msg) {
+		return msg, z, 0
+	}
+	return z, msg, fCompressed
+}
@@ -0,0 +1,65 @@
+package synapse
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestCompression(t *testing.T) {
+	srv, cln := net.Pipe()
+	go ServeConn(srv, EchoHandler{}, Compression(0))
+	cl, err := NewClient(cln, time.Second, Compression(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cl.Close()
+
+	if !cl.Features().Has(FeatureCompression) {
+		t.Fatal("expected compression to be negotiated")
+	}
+
+	// larger than maxMessageSize,
+	// but very compressible
+	in := testData(bytes.Repeat([]byte("compress me! "), 10000))
+	var out testData
+	err = cl.Call(Echo, &in, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(in, out) {
+		t.Fatal("input and output not equal")
+	}
+
+	// small bodies aren't compressed
+	small := testData("hi")
+	err = cl.Call(Echo, &small, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(small, out) {
+		t.Fatal("input and output not equal")
+	}
+}
+
+func TestNoCompression(t *testing.T) {
+	srv, cln := net.Pipe()
+	go ServeConn(srv, EchoHandler{})
+	cl, err := NewClient(cln, time.Second, Compression(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cl.Close()
+
+	if cl.Features().Has(FeatureCompression) {
+		t.Fatal("compression shouldn't be negotiated with a server that doesn't support it")
+	}
+	in := testData(bytes.Repeat([]byte("compress me! "), 10000))
+	var out testData
+	err = cl.Call(Echo, &in, &out)
+	if !errors.Is(err, ErrTooLarge) {
+		t.Fatalf("expected ErrTooLarge; got %v", err)
+	}
+}
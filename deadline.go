@@ -0,0 +1,161 @@
+package synapse
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+
+	"github.com/tinylib/synapse/sema"
+)
+
+// deadlines is a min-heap of pending
+// waiters ordered by deadline. the client's
+// timeout goroutine sleeps until the earliest
+// deadline, so timeouts fire within a small
+// bounded error, and idle clients don't do
+// any work at all.
+//
+// lock ordering: the heap lock is never
+// held while a wMap bucket is locked, or
+// vice-versa.
+type deadlines struct {
+	sync.Mutex
+	h       waitHeap
+	wake    chan struct{} // signals that the earliest deadline moved up
+	expired []uint64      // scratch space for expire()
+}
+
+func (d *deadlines) init() {
+	d.wake = make(chan struct{}, 1)
+}
+
+// waitHeap implements heap.Interface.
+// (*waiter).hidx is one more than the
+// waiter's index in the heap, or 0 if
+// it isn't in the heap.
+type waitHeap []*waiter
+
+func (h waitHeap) Len() int           { return len(h) }
+func (h waitHeap) Less(i, j int) bool { return h[i].deadline < h[j].deadline }
+func (h waitHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].hidx = i + 1
+	h[j].hidx = j + 1
+}
+
+func (h *waitHeap) Push(x interface{}) {
+	w := x.(*waiter)
+	*h = append(*h, w)
+	w.hidx = len(*h)
+}
+
+func (h *waitHeap) Pop() interface{} {
+	old := *h
+	w := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	w.hidx = 0
+	return w
+}
+
+// add schedules a timeout for 'w'
+// at w.deadline
+func (d *deadlines) add(w *waiter) {
+	d.Lock()
+	heap.Push(&d.h, w)
+	first := w.hidx == 1
+	d.Unlock()
+	if first {
+		select {
+		case d.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// remove cancels the timeout
+// for 'w', if it is scheduled
+func (d *deadlines) remove(w *waiter) {
+	d.Lock()
+	if w.hidx > 0 {
+		heap.Remove(&d.h, w.hidx-1)
+	}
+	d.Unlock()
+}
+
+// clear cancels every timeout
+func (d *deadlines) clear() {
+	d.Lock()
+	for i, w := range d.h {
+		w.hidx = 0
+		d.h[i] = nil
+	}
+	d.h = d.h[:0]
+	d.Unlock()
+}
+
+// expire removes every waiter whose deadline
+// is at or before 'now' and calls 'fn' with its
+// sequence number. it returns the next deadline,
+// or 0 if there are no more pending waiters.
+func (d *deadlines) expire(now int64, fn func(seq uint64)) (next int64) {
+	d.Lock()
+	d.expired = d.expired[:0]
+	for len(d.h) > 0 && d.h[0].deadline <= now {
+		w := heap.Pop(&d.h).(*waiter)
+		d.expired = append(d.expired, w.seq)
+	}
+	if len(d.h) > 0 {
+		next = d.h[0].deadline
+	}
+	expired := d.expired
+	d.Unlock()
+
+	// only the timeout goroutine
+	// calls expire(), so it's safe
+	// to use 'expired' unlocked
+	for _, seq := range expired {
+		fn(seq)
+	}
+	return next
+}
+
+// timeoutLoop fails waiters with ErrTimeout
+// once their deadlines pass. it sleeps until
+// the earliest deadline, or indefinitely if
+// there are no pending waiters.
+func (c *Client) timeoutLoop() {
+	timer := time.NewTimer(time.Hour)
+	timer.Stop()
+	expire := func(seq uint64) {
+		// if the waiter isn't in the map,
+		// a response is being delivered
+		if w := c.pending.remove(seq); w != nil {
+			w.err = ErrTimeout
+			sema.Wake(&w.done)
+		}
+	}
+	for {
+		next := c.deadlines.expire(time.Now().UnixNano(), expire)
+		var fire <-chan time.Time
+		if next != 0 {
+			timer.Reset(time.Until(time.Unix(0, next)))
+			fire = timer.C
+		}
+		select {
+		case <-c.done:
+			timer.Stop()
+			return
+		case <-c.deadlines.wake:
+			if !timer.Stop() && fire != nil {
+				// drain a timer that
+				// fired concurrently
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+		case <-fire:
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package synapse
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDeadlines(t *testing.T) {
+	var d deadlines
+	d.init()
+
+	vals := make([]waiter, 100)
+	for i := range vals {
+		vals[i].seq = uint64(i)
+		// reverse order
+		vals[i].deadline = int64(len(vals) - i)
+		d.add(&vals[i])
+	}
+
+	// remove odd sequence numbers
+	for i := 1; i < len(vals); i += 2 {
+		d.remove(&vals[i])
+		if vals[i].hidx != 0 {
+			t.Fatalf("waiter %d still has a heap index after removal", i)
+		}
+	}
+
+	var got []uint64
+	next := d.expire(50, func(seq uint64) { got = append(got, seq) })
+	// deadline 51 is seq 49, which was removed
+	if next != 52 {
+		t.Errorf("expected next deadline 52; got %d", next)
+	}
+	// deadlines 1-50 are seq 99-50;
+	// only the even ones are left
+	if len(got) != 25 {
+		t.Fatalf("expected 25 expired waiters; got %d", len(got))
+	}
+	for i, seq := range got {
+		if seq != uint64(98-2*i) {
+			t.Errorf("expired out of order: position %d is seq %d", i, seq)
+		}
+	}
+
+	d.clear()
+	if next := d.expire(1000, func(uint64) { t.Error("nothing should expire after clear()") }); next != 0 {
+		t.Errorf("expected no next deadline; got %d", next)
+	}
+}
+
+func TestCallTimeout(t *testing.T) {
+	in := testData("hello")
+
+	// tcpClient has a 5ms timeout; a
+	// long call timeout should still work
+	err := tcpClient.CallTimeout(Echo, &in, nil, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -2,6 +2,9 @@ package synapse
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"log"
 	"net"
@@ -28,17 +31,74 @@ type logger interface {
 	Printf(string, ...interface{})
 }
 
-type debugh struct {
-	inner  Handler
+// debugLog writes the log lines
+// for Debug and DebugCalls, so that
+// both sides of a call look the same
+type debugLog struct {
 	logger logger
+	redact *redactor // may be nil
+}
+
+// request logs a request. 'dir' is "from"
+// on the server side and "to" on the client
+// side. it returns an error if the body
+// can't be converted to JSON.
+func (d *debugLog) request(dir string, remote string, m Method, body []byte) error {
+	var buf bytes.Buffer
+	_, err := d.redact.json(&buf, m, body)
+	if err != nil {
+		d.logger.Printf("request %s %s for %s was malformed: %s", dir, remote, m, err)
+		return err
+	}
+	d.logger.Printf("request %s %s:\n\tMETHOD: %s\n\tREQUEST BODY: %s\n", dir, remote, m, buf.Bytes())
+	return nil
+}
+
+// response logs a response. 'dir' is "to"
+// on the server side and "from" on the client
+// side. 'body' is the response body for
+// successful calls, and the encoded explanation
+// for failed ones.
+func (d *debugLog) response(dir string, remote string, m Method, status Status, body []byte, elapsed time.Duration) {
+	var buf bytes.Buffer
+	_, err := d.redact.json(&buf, m, body)
+	if err != nil {
+		d.logger.Printf("response %s %s for %s was malformed: %s", dir, remote, m, err)
+		return
+	}
+	d.logger.Printf("response %s %s for %s:\n\tSTATUS: %s\n\tRESPONSE BODY: %s\n\tDURATION: %s\n", dir, remote, m, status, buf.Bytes(), elapsed)
+}
+
+type debugh struct {
+	inner Handler
+	debugLog
 }
 
 // Debug wraps a handler and logs all of the incoming
 // and outgoing data using the provided logger.
+// For structured logs, see AccessLog. For the
+// client side, see DebugCalls.
 func Debug(h Handler, l *log.Logger) Handler {
-	return &debugh{inner: h, logger: l}
+	return &debugh{inner: h, debugLog: debugLog{logger: l}}
+}
+
+// DebugRedacted is like Debug, but it
+// applies 'r' to the bodies that it logs.
+func DebugRedacted(h Handler, l *log.Logger, r Redaction) Handler {
+	return &debugh{inner: h, debugLog: debugLog{logger: l, redact: r.compile()}}
+}
+
+// Debugger returns a Middleware that
+// wraps handlers with Debug using the
+// provided logger.
+func Debugger(l *log.Logger) Middleware {
+	return func(h Handler) Handler { return Debug(h, l) }
 }
 
+// Methods implements MethodLister
+// if the wrapped handler does.
+func (d *debugh) Methods() []MethodInfo { return HandlerMethods(d.inner) }
+
 func (d *debugh) ServeCall(req Request, res ResponseWriter) {
 	// if we're handed the base types
 	// used by the package, we can do this
@@ -50,24 +110,24 @@ func (d *debugh) ServeCall(req Request, res ResponseWriter) {
 		}
 	}
 
-	var buf bytes.Buffer
 	nm := req.Method()
 	remote := req.RemoteAddr()
 
 	var raw msgp.Raw
 	err := req.Decode(&raw)
 	if err != nil {
-		d.logger.Printf("request from %s for method %s is malformed: %s\n", remote, nm, err)
+		d.logger.Printf("request from %s for %s was malformed: %s", remote, nm, err)
 		res.Error(StatusBadRequest, err.Error())
 		return
 	}
-	msgp.UnmarshalAsJSON(&buf, []byte(raw))
-	d.logger.Printf("request from %s:\n\tMETHOD: %s\n\tBODY: %s\n", remote, nm, buf.Bytes())
-	buf.Reset()
+	d.request("from", remote.String(), nm, []byte(raw))
 	r := &mockReq{
 		mtd:    nm,
 		remote: remote,
 		raw:    raw,
+		md:     RequestMetadata(req),
+		ctx:    RequestContext(req),
+		tls:    RequestTLS(req),
 	}
 	w := &mockRes{}
 	start := time.Now()
@@ -78,29 +138,44 @@ func (d *debugh) ServeCall(req Request, res ResponseWriter) {
 		res.Error(StatusServerError, "empty response")
 		return
 	}
-	msgp.UnmarshalAsJSON(&buf, []byte(w.out))
-	d.logger.Printf("response to %s for method %s:\n\tSTATUS: %s\n\tBODY: %s\n\tDURATION: %s", remote, nm, w.status, buf.Bytes(), ctime)
+	d.response("to", remote.String(), nm, w.status, w.out, ctime)
+	if w.err != nil {
+		SendError(res, w.err)
+		return
+	}
 	res.Send(msgp.Raw(w.out))
 }
 
 type mockReq struct {
 	remote net.Addr
 	raw    msgp.Raw
+	md     Metadata
 	mtd    Method
+	ctx    context.Context
+	tls    *tls.ConnectionState
 }
 
-func (m *mockReq) IsNil() bool          { return msgp.IsNil([]byte(m.raw)) }
-func (m *mockReq) Method() Method       { return m.mtd }
-func (m *mockReq) RemoteAddr() net.Addr { return m.remote }
+func (m *mockReq) IsNil() bool               { return msgp.IsNil([]byte(m.raw)) }
+func (m *mockReq) Method() Method            { return m.mtd }
+func (m *mockReq) RemoteAddr() net.Addr      { return m.remote }
+func (m *mockReq) Metadata() Metadata        { return m.md }
+func (m *mockReq) Context() context.Context  { return m.ctx }
+func (m *mockReq) TLS() *tls.ConnectionState { return m.tls }
 func (m *mockReq) Decode(u msgp.Unmarshaler) error {
 	_, err := u.UnmarshalMsg([]byte(m.raw))
 	return err
 }
 
+// the body is already a copy,
+// so it can always be retained
+func (m *mockReq) Body() []byte   { return []byte(m.raw) }
+func (m *mockReq) Retain() []byte { return []byte(m.raw) }
+
 type mockRes struct {
 	wrote  bool
 	out    []byte
 	status Status
+	err    *ResponseError // set if status != StatusOK
 }
 
 func (m *mockRes) Send(g msgp.Marshaler) error {
@@ -108,35 +183,37 @@ func (m *mockRes) Send(g msgp.Marshaler) error {
 		return nil
 	}
 	m.wrote = true
+	m.status = StatusOK
+	if g == nil {
+		m.out = msgp.AppendNil(m.out)
+		return nil
+	}
 	var err error
 	m.out, err = g.MarshalMsg(nil)
-	if err != nil {
-		return err
-	}
-	m.status = StatusOK
-	return nil
+	return err
 }
 
 func (m *mockRes) Error(s Status, r string) {
+	m.WriteError(&ResponseError{Code: s, Expl: r})
+}
+
+func (m *mockRes) WriteError(e *ResponseError) {
 	if m.wrote {
 		return
 	}
 	m.wrote = true
-	m.status = s
-	m.out = msgp.AppendString(m.out, r)
+	m.status = e.Code
+	m.err = e
+	m.out = msgp.AppendString(m.out, e.Expl)
 }
 
 func (d *debugh) serveBase(req *request, res *response) {
-	var buf bytes.Buffer
-	_, err := msgp.UnmarshalAsJSON(&buf, req.in)
 	remote := req.addr.String()
+	err := d.request("from", remote, Method(req.mtd), req.in)
 	if err != nil {
-		d.logger.Printf("request from %s for %s was malformed: %s", remote, Method(req.mtd), err)
 		res.Error(StatusBadRequest, err.Error())
 		return
 	}
-	d.logger.Printf("request from %s:\n\tMETHOD: %s\n\tREQUEST BODY: %s\n", remote, Method(req.mtd), buf.Bytes())
-	buf.Reset()
 	start := time.Now()
 	d.inner.ServeCall(req, res)
 	ctime := time.Since(start)
@@ -153,11 +230,58 @@ func (d *debugh) serveBase(req *request, res *response) {
 		d.logger.Printf("body of response to %s is malformed: %s", Method(req.mtd), err)
 		return
 	}
-	status := Status(stat)
-	_, err = msgp.UnmarshalAsJSON(&buf, body)
-	if err != nil {
-		d.logger.Printf("response for %s is malformed: %s", Method(req.mtd), err)
-		return
+	d.response("to", remote, Method(req.mtd), Status(stat), body, ctime)
+}
+
+// DebugCalls makes a client log every
+// call that it makes using the provided
+// logger, in the same format as Debug.
+// It has no effect on servers.
+func DebugCalls(l *log.Logger) Option {
+	return func(c *config) {
+		c.debug = &debugLog{logger: l}
+	}
+}
+
+// DebugCallsRedacted is like DebugCalls, but
+// it applies 'r' to the bodies that it logs.
+func DebugCallsRedacted(l *log.Logger, r Redaction) Option {
+	return func(c *config) {
+		c.debug = &debugLog{logger: l, redact: r.compile()}
+	}
+}
+
+// debugCalls is the Interceptor installed
+// by DebugCalls. it is the innermost interceptor,
+// so it logs what is actually sent.
+func (c *Client) debugCalls(next Invoker) Invoker {
+	d := c.cfg.debug
+	remote := c.conn.RemoteAddr().String()
+	return func(ctx context.Context, method Method, in msgp.Marshaler, out msgp.Unmarshaler) error {
+		body, err := encodeBody(in)
+		if err != nil {
+			d.logger.Printf("request to %s for %s could not be encoded: %s", remote, method, err)
+			return err
+		}
+		d.request("to", remote, method, body)
+
+		var raw msgp.Raw
+		start := time.Now()
+		err = next(ctx, method, msgp.Raw(body), &raw)
+		ctime := time.Since(start)
+		if err != nil {
+			var re *ResponseError
+			if errors.As(err, &re) {
+				d.response("from", remote, method, re.Code, msgp.AppendString(nil, re.Expl), ctime)
+			} else {
+				d.logger.Printf("call to %s for %s failed after %s: %s", remote, method, ctime, err)
+			}
+			return err
+		}
+		d.response("from", remote, method, StatusOK, raw, ctime)
+		if out != nil {
+			_, err = out.UnmarshalMsg(raw)
+		}
+		return err
 	}
-	d.logger.Printf("response to %s for %s:\n\tSTATUS: %s\n\tRESPONSE BODY: %s\n\tDURATION: %s\n", remote, Method(req.mtd), status, buf.Bytes(), ctime)
 }
@@ -0,0 +1,53 @@
+package synapse
+
+import (
+	"bytes"
+	"log"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tinylib/msgp/msgp"
+)
+
+func TestDebugCalls(t *testing.T) {
+	var logs bytes.Buffer
+	rt := &RouteTable{Echo: EchoHandler{}, Fail: FailHandler{}}
+	srv, cln := net.Pipe()
+	go ServeConn(srv, rt)
+	cl, err := NewClient(cln, time.Second,
+		DebugCallsRedacted(log.New(&logs, "", 0), Redaction{Paths: []string{"user.password"}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cl.Close()
+
+	// the response should still be
+	// decoded into the caller's value
+	var out msgp.Raw
+	if err := cl.Call(Echo, msgp.Raw(redactBody()), &out); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, redactBody()) {
+		t.Errorf("response body was not decoded; got %x", []byte(out))
+	}
+	text := logs.String()
+	if strings.Contains(text, "hunter2") {
+		t.Errorf("password was logged:\n%s", text)
+	}
+	for _, want := range []string{"request to", "response from", "METHOD: echo", "STATUS: OK", "bob", "DURATION:"} {
+		if !strings.Contains(text, want) {
+			t.Errorf("expected %q in the log:\n%s", want, text)
+		}
+	}
+
+	logs.Reset()
+	if err := cl.Call(Fail, nil, nil); err == nil {
+		t.Fatal("expected an error")
+	}
+	text = logs.String()
+	if !strings.Contains(text, "response from") || strings.Contains(text, "STATUS: OK") {
+		t.Errorf("expected the failure status in the log:\n%s", text)
+	}
+}
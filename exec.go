@@ -0,0 +1,171 @@
+package synapse
+
+import (
+	"runtime"
+	"sync"
+)
+
+// ExecMode determines how a server
+// executes handlers for requests.
+type ExecMode int
+
+const (
+	// PerRequest runs each request
+	// in a new goroutine. This is the
+	// default.
+	PerRequest ExecMode = iota
+
+	// WorkerPool runs requests on a fixed
+	// number of long-lived goroutines shared
+	// by all of the server's connections.
+	// This reduces scheduler overhead and
+	// stack growth for small, CPU-bound
+	// handlers. When every worker is busy,
+	// connections stop reading new requests
+	// until one is free, so handlers must
+	// not block on other requests to the
+	// same server.
+	WorkerPool
+
+	// Inline runs small requests on the
+	// goroutine that reads the connection,
+	// and the rest on a worker pool, like
+	// WorkerPool. No other requests on the
+	// connection are read until an inline
+	// handler returns, so it is only suitable
+	// for servers whose handlers for small
+	// requests never block. See InlineLimit.
+	Inline
+)
+
+// defaultInlineLimit is the largest
+// request body that Inline runs inline
+// unless InlineLimit is used
+const defaultInlineLimit = 512
+
+// maxQueued is the most requests that a
+// connection can have in progress when
+// workers are used. it bounds the responses
+// that can pile up for a slow connection.
+const maxQueued = 64
+
+// Execution sets the way that a server
+// executes handlers. For WorkerPool and
+// Inline, 'workers' is the number of worker
+// goroutines; if it is 0 or less,
+// runtime.GOMAXPROCS(0) is used. 'workers' is
+// ignored for PerRequest. Execution has no
+// effect on clients.
+func Execution(mode ExecMode, workers int) Option {
+	return func(c *config) {
+		if workers <= 0 {
+			workers = runtime.GOMAXPROCS(0)
+		}
+		c.exec = mode
+		c.workers = workers
+	}
+}
+
+// InlineLimit sets the largest request body,
+// in bytes, that the Inline execution mode runs
+// inline. Larger requests are run by workers.
+// The default is 512 bytes. InlineLimit has no
+// effect on clients, or in other modes.
+func InlineLimit(size int) Option {
+	return func(c *config) {
+		c.inline = size
+		c.inlineSet = true
+	}
+}
+
+// inlineLimit returns the
+// configured InlineLimit
+func (c *config) inlineLimit() int {
+	if c.inlineSet {
+		return c.inline
+	}
+	return defaultInlineLimit
+}
+
+// job is a request to
+// be executed by a worker
+type job struct {
+	c *connHandler
+	w *connWrapper
+}
+
+// workerPool is a pool of worker
+// goroutines. workers run for as long
+// as the server has open connections.
+type workerPool struct {
+	sync.Mutex
+	conns int      // open connections
+	queue chan job // closed when conns drops to 0
+}
+
+// acquire registers a connection with
+// the pool, starting 'size' workers if
+// necessary, and returns the job queue.
+func (p *workerPool) acquire(size int) chan<- job {
+	p.Lock()
+	if p.conns == 0 {
+		p.queue = make(chan job, size)
+		for i := 0; i < size; i++ {
+			go work(p.queue)
+		}
+	}
+	p.conns++
+	q := p.queue
+	p.Unlock()
+	return q
+}
+
+// release unregisters a connection
+// from the pool. it must only be called
+// once the connection's handlers have
+// all returned.
+func (p *workerPool) release() {
+	p.Lock()
+	p.conns--
+	if p.conns == 0 {
+		close(p.queue)
+		p.queue = nil
+	}
+	p.Unlock()
+}
+
+func work(queue <-chan job) {
+	for j := range queue {
+		j.c.handleReq(j.w)
+	}
+}
+
+// queue hands a response to the write loop.
+// workers are shared by every connection, so
+// they must not wait for a slow connection:
+// if its write queue is full, the response
+// is queued by a new goroutine instead. the
+// number of those is bounded by c.slots.
+func (c *connHandler) queue(cw *connWrapper) {
+	if c.slots == nil {
+		c.writing <- cw
+		c.wg.Done()
+		return
+	}
+	select {
+	case c.writing <- cw:
+		c.finished()
+	default:
+		go func() {
+			c.writing <- cw
+			c.finished()
+		}()
+	}
+}
+
+// finished releases the slot
+// taken by connLoop for a request
+func (c *connHandler) finished() {
+	<-c.slots
+	c.wg.Done()
+}
@@ -0,0 +1,156 @@
+package synapse
+
+import (
+	"bytes"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tinylib/msgp/msgp"
+)
+
+func TestExecModes(t *testing.T) {
+	modes := []struct {
+		name string
+		mode ExecMode
+	}{
+		{"PerRequest", PerRequest},
+		{"WorkerPool", WorkerPool},
+		{"Inline", Inline},
+	}
+	for _, m := range modes {
+		t.Run(m.name, func(t *testing.T) {
+			srv := NewServer(EchoHandler{}, Execution(m.mode, 2))
+
+			// two connections share
+			// the same workers
+			var clients []*Client
+			for i := 0; i < 2; i++ {
+				sc, cc := net.Pipe()
+				go srv.ServeConn(sc)
+				cl, err := NewClient(cc, time.Second)
+				if err != nil {
+					t.Fatal(err)
+				}
+				clients = append(clients, cl)
+			}
+
+			var wg sync.WaitGroup
+			for _, cl := range clients {
+				for i := 0; i < 10; i++ {
+					wg.Add(1)
+					go func(cl *Client) {
+						defer wg.Done()
+						for j := 0; j < 50; j++ {
+							in := testData("hello, world!")
+							var out testData
+							if err := cl.Call(Echo, &in, &out); err != nil {
+								t.Error(err)
+								return
+							}
+							if !bytes.Equal(in, out) {
+								t.Errorf("%q in; %q out", in, out)
+								return
+							}
+						}
+					}(cl)
+				}
+			}
+			wg.Wait()
+
+			for _, cl := range clients {
+				cl.Close()
+			}
+			if m.mode != WorkerPool {
+				return
+			}
+			// workers should stop once
+			// every connection is closed
+			deadline := time.Now().Add(time.Second)
+			for {
+				srv.workers.Lock()
+				conns, q := srv.workers.conns, srv.workers.queue
+				srv.workers.Unlock()
+				if conns == 0 && q == nil {
+					break
+				}
+				if time.Now().After(deadline) {
+					t.Fatalf("workers still running for %d connections", conns)
+				}
+				time.Sleep(5 * time.Millisecond)
+			}
+		})
+	}
+}
+
+// large requests don't run inline, so a
+// slow handler for one doesn't hold up
+// the rest of the connection
+func TestInlineLimit(t *testing.T) {
+	release := make(chan struct{})
+	slow := HandlerFunc(func(req Request, res ResponseWriter) {
+		<-release
+		res.Send(nil)
+	})
+	rt := &RouteTable{Echo: EchoHandler{}, Nop: slow}
+	srv, cln := net.Pipe()
+	go ServeConn(srv, rt, Execution(Inline, 1), InlineLimit(64))
+	cl, err := NewClient(cln, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cl.Close()
+
+	done := make(chan error, 1)
+	big := testData(bytes.Repeat([]byte("x"), 256))
+	go func() { done <- cl.Call(Nop, &big, nil) }()
+	time.Sleep(10 * time.Millisecond)
+
+	in := testData("small")
+	var out testData
+	if err := cl.Call(Echo, &in, &out); err != nil {
+		t.Fatal(err)
+	}
+	close(release)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// a connection that doesn't read its
+// responses can't tie up the workers
+// shared with other connections
+func TestWorkerPoolSlowConn(t *testing.T) {
+	srv := NewServer(EchoHandler{}, Execution(WorkerPool, 1))
+
+	slow, raw := net.Pipe()
+	defer raw.Close()
+	go srv.ServeConn(slow)
+	go func() {
+		body := msgp.AppendUint32(nil, uint32(Echo))
+		body = msgp.AppendString(body, "hello")
+		frame := make([]byte, leadSize+len(body))
+		copy(frame[leadSize:], body)
+		for seq := uint64(1); seq <= 500; seq++ {
+			putFrame(frame, seq, fREQ, len(body))
+			if _, err := raw.Write(frame); err != nil {
+				return
+			}
+		}
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	sc, cc := net.Pipe()
+	go srv.ServeConn(sc)
+	cl, err := NewClient(cc, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cl.Close()
+	in := testData("hello")
+	var out testData
+	if err := cl.Call(Echo, &in, &out); err != nil {
+		t.Fatal(err)
+	}
+}
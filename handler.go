@@ -2,6 +2,9 @@ package synapse
 
 import (
 	"fmt"
+	"time"
+
+	"github.com/tinylib/msgp/msgp"
 )
 
 // Handler is the interface used
@@ -29,23 +32,63 @@ type Status int
 // an error to send to the
 // client.
 const (
-	StatusInvalid     Status = iota // zero-value for Status
-	StatusOK                        // OK
-	StatusNotFound                  // no handler for the request method
-	StatusCondition                 // precondition failure
-	StatusBadRequest                // mal-formed request
-	StatusNotAuthed                 // not authorized
-	StatusServerError               // server-side error
-	StatusOther                     // other error
+	StatusInvalid       Status = iota // zero-value for Status
+	StatusOK                          // OK
+	StatusNotFound                    // no handler for the request method
+	StatusCondition                   // precondition failure
+	StatusBadRequest                  // mal-formed request
+	StatusNotAuthed                   // not authorized
+	StatusServerError                 // server-side error
+	StatusOther                       // other error
+	StatusTimeout                     // the request took too long
+	StatusUnavailable                 // the service is (temporarily) unavailable
+	StatusOverloaded                  // the server is overloaded
+	StatusCancelled                   // the request was cancelled
+	StatusAlreadyExists               // the resource already exists
+	StatusExhausted                   // a resource (e.g. a quota) is exhausted
 )
 
+// StatusAppMin is the first of the status
+// codes reserved for applications. The
+// codes below it are reserved for use by
+// this package. Use RegisterStatus to
+// give application-defined codes names.
+const StatusAppMin Status = 1000
+
+var statusTab = map[Status]string{}
+
+// RegisterStatus sets the name of an
+// application-defined status code, which
+// is used by Status.String (and thus in
+// errors and debug logs.) It panics if
+// 's' is less than StatusAppMin. Like
+// RegisterName, it should be called
+// during initialization.
+func RegisterStatus(s Status, name string) {
+	if s < StatusAppMin {
+		panic(fmt.Sprintf("synapse: status code %d is reserved", int(s)))
+	}
+	statusTab[s] = name
+}
+
 // ResponseError is the type of error
 // returned by the client when the
 // server sends a response with
 // ResponseWriter.Error()
+//
+// Handlers can send the optional fields
+// (AppCode, Retryable, RetryAfter and Details)
+// by passing a *ResponseError to SendError.
+// Servers that don't support them, and
+// ResponseWriters that aren't ErrorWriters,
+// send only the Code and Expl.
 type ResponseError struct {
-	Code Status
-	Expl string
+	Code       Status        // status code
+	Expl       string        // explanation
+	AppCode    int           // application-defined error code
+	Retryable  bool          // whether or not the call can be retried
+	RetryAfter time.Duration // minimum time to wait before retrying
+	Details    msgp.Raw      // arbitrary application-defined details
 }
 
 // Error implements error
@@ -53,6 +96,111 @@ func (e *ResponseError) Error() string {
 	return fmt.Sprintf("synapse: response error (%s): %s", e.Code, e.Expl)
 }
 
+// hasDetails returns whether or
+// not any of the optional fields
+// of the error are set
+func (e *ResponseError) hasDetails() bool {
+	return e.AppCode != 0 || e.Retryable || e.RetryAfter != 0 || len(e.Details) > 0
+}
+
+// An ErrorWriter is a ResponseWriter that
+// can send the optional fields of a
+// ResponseError. The ResponseWriter passed
+// to handlers by this package is an ErrorWriter.
+type ErrorWriter interface {
+	ResponseWriter
+
+	// WriteError sets the error returned
+	// to the caller. Like Error, it no-ops
+	// if a response has already been written.
+	WriteError(*ResponseError)
+}
+
+// appendErrorDetails appends the
+// optional fields of 'e' as a map.
+// only the fields that are set
+// are written.
+func appendErrorDetails(b []byte, e *ResponseError) []byte {
+	var n uint32
+	if e.AppCode != 0 {
+		n++
+	}
+	if e.Retryable {
+		n++
+	}
+	if e.RetryAfter != 0 {
+		n++
+	}
+	if len(e.Details) > 0 {
+		n++
+	}
+	b = msgp.AppendMapHeader(b, n)
+	if e.AppCode != 0 {
+		b = msgp.AppendString(b, "code")
+		b = msgp.AppendInt(b, e.AppCode)
+	}
+	if e.Retryable {
+		b = msgp.AppendString(b, "retry")
+		b = msgp.AppendBool(b, true)
+	}
+	if e.RetryAfter != 0 {
+		b = msgp.AppendString(b, "after")
+		b = msgp.AppendInt64(b, int64(e.RetryAfter))
+	}
+	if len(e.Details) > 0 {
+		b = msgp.AppendString(b, "details")
+		b = append(b, e.Details...)
+	}
+	return b
+}
+
+// readError reads the body of an
+// error response: an explanation
+// string, optionally followed by a
+// map of details.
+func readError(code Status, body []byte) *ResponseError {
+	e := &ResponseError{Code: code}
+	var err error
+	e.Expl, body, err = msgp.ReadStringBytes(body)
+	if err != nil {
+		e.Expl = "<?>"
+		return e
+	}
+	if len(body) == 0 || msgp.NextType(body) != msgp.MapType {
+		return e
+	}
+	var fields uint32
+	fields, body, err = msgp.ReadMapHeaderBytes(body)
+	if err != nil {
+		return e
+	}
+	for ; fields > 0; fields-- {
+		var key []byte
+		key, body, err = msgp.ReadMapKeyZC(body)
+		if err != nil {
+			return e
+		}
+		switch msgp.UnsafeString(key) {
+		case "code":
+			e.AppCode, body, err = msgp.ReadIntBytes(body)
+		case "retry":
+			e.Retryable, body, err = msgp.ReadBoolBytes(body)
+		case "after":
+			var d int64
+			d, body, err = msgp.ReadInt64Bytes(body)
+			e.RetryAfter = time.Duration(d)
+		case "details":
+			body, err = e.Details.UnmarshalMsg(body)
+		default:
+			body, err = msgp.Skip(body)
+		}
+		if err != nil {
+			return e
+		}
+	}
+	return e
+}
+
 // String returns the string representation of the status
 func (s Status) String() string {
 	switch s {
@@ -70,7 +218,52 @@ func (s Status) String() string {
 		return "server error"
 	case StatusOther:
 		return "other"
+	case StatusTimeout:
+		return "timeout"
+	case StatusUnavailable:
+		return "unavailable"
+	case StatusOverloaded:
+		return "overloaded"
+	case StatusCancelled:
+		return "cancelled"
+	case StatusAlreadyExists:
+		return "already exists"
+	case StatusExhausted:
+		return "resource exhausted"
 	default:
+		if str, ok := statusTab[s]; ok {
+			return str
+		}
 		return fmt.Sprintf("Status(%d)", s)
 	}
 }
+
+// HandlerFunc is an adapter that allows
+// an ordinary function to be used as
+// a Handler.
+type HandlerFunc func(req Request, res ResponseWriter)
+
+// ServeCall implements Handler by calling f(req, res).
+func (f HandlerFunc) ServeCall(req Request, res ResponseWriter) { f(req, res) }
+
+// Middleware is a function that wraps
+// a Handler in another Handler. Middlewares
+// are the standard way to attach cross-cutting
+// behavior (logging, auth, etc.) to a server.
+type Middleware func(Handler) Handler
+
+// Chain composes a list of middlewares into
+// a single Middleware. The first middleware in
+// the list is the outermost one; that is,
+//
+//  Chain(a, b, c)(h)
+//
+// is equivalent to a(b(c(h))).
+func Chain(m ...Middleware) Middleware {
+	return func(h Handler) Handler {
+		for i := len(m) - 1; i >= 0; i-- {
+			h = m[i](h)
+		}
+		return h
+	}
+}
@@ -0,0 +1,72 @@
+package synapse
+
+import (
+	"testing"
+)
+
+func TestChain(t *testing.T) {
+	var order []string
+	mark := func(name string) Middleware {
+		return func(h Handler) Handler {
+			return HandlerFunc(func(req Request, res ResponseWriter) {
+				order = append(order, name)
+				h.ServeCall(req, res)
+			})
+		}
+	}
+
+	h := Chain(mark("a"), mark("b"), mark("c"))(HandlerFunc(func(req Request, res ResponseWriter) {
+		order = append(order, "h")
+		res.Send(String("ok"))
+	}))
+
+	res := &mockRes{}
+	h.ServeCall(&mockReq{mtd: Nop}, res)
+	if !res.wrote || res.status != StatusOK {
+		t.Fatal("handler didn't write a response")
+	}
+
+	want := []string{"a", "b", "c", "h"}
+	if len(order) != len(want) {
+		t.Fatalf("expected call order %v; got %v", want, order)
+	}
+	for i := range want {
+		if order[i] != want[i] {
+			t.Fatalf("expected call order %v; got %v", want, order)
+		}
+	}
+}
+
+func TestStatusString(t *testing.T) {
+	const StatusTeapot = StatusAppMin + 18
+	RegisterStatus(StatusTeapot, "I'm a teapot")
+
+	for s, want := range map[Status]string{
+		StatusOK:            "OK",
+		StatusExhausted:     "resource exhausted",
+		StatusTeapot:        "I'm a teapot",
+		StatusTeapot + 1:    "Status(1019)",
+		StatusAlreadyExists: "already exists",
+		StatusAppMin - 1:    "Status(999)",
+	} {
+		if got := s.String(); got != want {
+			t.Errorf("expected %q; got %q", want, got)
+		}
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("expected RegisterStatus to panic for a reserved code")
+		}
+	}()
+	RegisterStatus(StatusTimeout, "bad")
+}
+
+func TestRouteTableBounds(t *testing.T) {
+	rt := &RouteTable{Echo: EchoHandler{}}
+	res := &mockRes{}
+	rt.ServeCall(&mockReq{mtd: Method(len(*rt))}, res)
+	if res.status != StatusNotFound {
+		t.Errorf("expected StatusNotFound; got %s", res.status)
+	}
+}
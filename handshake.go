@@ -0,0 +1,181 @@
+package synapse
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/tinylib/msgp/msgp"
+)
+
+// ProtocolVersion is the version of the
+// synapse wire protocol implemented by
+// this package. Peers that don't support
+// the handshake are treated as version 0.
+const ProtocolVersion = 1
+
+// Features is a set of optional
+// protocol features. The features
+// used on a connection are the ones
+// supported by both peers.
+type Features uint32
+
+const (
+	// FeatureHeaders indicates support
+	// for request and response metadata.
+	FeatureHeaders Features = 1 << iota
+
+	// FeatureCompression indicates support
+	// for compressed message bodies.
+	FeatureCompression
+)
+
+// Has returns whether or not every
+// feature in 'g' is present in 'f'.
+func (f Features) Has(g Features) bool { return f&g == g }
+
+// PeerInfo describes the protocol capabilities
+// of one end of a connection, as sent during
+// the connection handshake.
+type PeerInfo struct {
+	Version        uint32   // protocol version
+	Frames         uint32   // supported frame types; bit N is set for frame type N
+	Features       Features // supported optional features
+	MaxMessageSize int      // largest message body accepted
+}
+
+// localInfo returns the PeerInfo
+// describing this end of the connection.
+// request metadata is always supported.
+func localInfo(cfg *config) PeerInfo {
+	return PeerInfo{
+		Version:        ProtocolVersion,
+		Frames:         1<<fREQ | 1<<fRES | 1<<fCMD | 1<<fPING | 1<<fPONG,
+		Features:       cfg.features | FeatureHeaders,
+		MaxMessageSize: maxMessageSize,
+	}
+}
+
+// MarshalMsg implements msgp.Marshaler
+func (p *PeerInfo) MarshalMsg(b []byte) ([]byte, error) {
+	b = msgp.AppendMapHeader(b, 4)
+	b = msgp.AppendString(b, "version")
+	b = msgp.AppendUint32(b, p.Version)
+	b = msgp.AppendString(b, "frames")
+	b = msgp.AppendUint32(b, p.Frames)
+	b = msgp.AppendString(b, "features")
+	b = msgp.AppendUint32(b, uint32(p.Features))
+	b = msgp.AppendString(b, "maxsize")
+	b = msgp.AppendInt(b, p.MaxMessageSize)
+	return b, nil
+}
+
+// UnmarshalMsg implements msgp.Unmarshaler.
+// Unknown fields are ignored.
+func (p *PeerInfo) UnmarshalMsg(b []byte) ([]byte, error) {
+	fields, b, err := msgp.ReadMapHeaderBytes(b)
+	if err != nil {
+		return b, err
+	}
+	for ; fields > 0; fields-- {
+		var key []byte
+		key, b, err = msgp.ReadMapKeyZC(b)
+		if err != nil {
+			return b, err
+		}
+		switch msgp.UnsafeString(key) {
+		case "version":
+			p.Version, b, err = msgp.ReadUint32Bytes(b)
+		case "frames":
+			p.Frames, b, err = msgp.ReadUint32Bytes(b)
+		case "features":
+			var f uint32
+			f, b, err = msgp.ReadUint32Bytes(b)
+			p.Features = Features(f)
+		case "maxsize":
+			p.MaxMessageSize, b, err = msgp.ReadIntBytes(b)
+		default:
+			b, err = msgp.Skip(b)
+		}
+		if err != nil {
+			return b, err
+		}
+	}
+	return b, nil
+}
+
+// hello is the handshake command. the
+// client sends its PeerInfo, and the server
+// responds with its own.
+type hello struct{}
+
+func (h hello) Client(cl *Client, res []byte) {}
+
+func (h hello) Server(ch *connHandler, body []byte) ([]byte, error) {
+	var p PeerInfo
+	_, err := p.UnmarshalMsg(body)
+	if err != nil {
+		return nil, err
+	}
+	ch.plock.Lock()
+	ch.peer = p
+	ch.plock.Unlock()
+	local := localInfo(ch.cfg)
+	atomic.StoreUint32(&ch.features, uint32(p.Features&local.Features))
+	return local.MarshalMsg(nil)
+}
+
+// helloTimeout is the longest that a client
+// waits for a response to the handshake
+const helloTimeout = time.Second
+
+// handshake exchanges PeerInfo with the server.
+// if the server doesn't understand the handshake,
+// it falls back to a ping and treats the server
+// as a version 0 peer with no optional features.
+// servers that predate the handshake don't
+// respond to unknown commands at all, so the
+// handshake has a short timeout.
+func (c *Client) handshake() error {
+	local := localInfo(&c.cfg)
+	body, _ := local.MarshalMsg(nil)
+	timeout := helloTimeout
+	if c.timeout > 0 && c.timeout < timeout {
+		timeout = c.timeout
+	}
+	var p PeerInfo
+	err := c.sendCommandTimeout(cmdHello, body, &p, timeout)
+	if err == errInvalidCmd || err == ErrTimeout {
+		p = PeerInfo{}
+		err = c.ping()
+	}
+	if err != nil {
+		return err
+	}
+	c.peer = p
+	c.feats = p.Features & local.Features
+	return nil
+}
+
+// Peer returns the PeerInfo sent
+// by the server during the handshake.
+func (c *Client) Peer() PeerInfo { return c.peer }
+
+// Features returns the set of optional
+// features supported by both the client
+// and the server.
+func (c *Client) Features() Features { return c.feats }
+
+// peerInfo returns the PeerInfo sent
+// by the client during the handshake.
+func (c *connHandler) peerInfo() PeerInfo {
+	c.plock.Lock()
+	p := c.peer
+	c.plock.Unlock()
+	return p
+}
+
+// negotiated returns the set of optional
+// features negotiated with the client.
+func (c *connHandler) negotiated() Features {
+	return Features(atomic.LoadUint32(&c.features))
+}
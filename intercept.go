@@ -0,0 +1,71 @@
+package synapse
+
+import (
+	"context"
+	"time"
+
+	"github.com/tinylib/msgp/msgp"
+)
+
+// An Invoker makes a call. (*Client).CallContext
+// has the signature of an Invoker.
+type Invoker func(ctx context.Context, method Method, in msgp.Marshaler, out msgp.Unmarshaler) error
+
+// An Interceptor wraps the calls made by a
+// Client, much like a Middleware wraps a
+// Handler. An Interceptor may modify the
+// context (for instance, to add metadata)
+// before passing the call to 'next'.
+type Interceptor func(next Invoker) Invoker
+
+// Intercept installs interceptors on a client.
+// The first interceptor is the outermost one.
+// Every call made by the client, including Call
+// and CallTimeout, passes through the interceptors.
+// Intercept has no effect on servers.
+func Intercept(i ...Interceptor) Option {
+	return func(c *config) {
+		c.intercept = append(c.intercept, i...)
+	}
+}
+
+// the context key for the timeout
+// passed to CallTimeout when the
+// client has interceptors
+type timeoutKey struct{}
+
+// chain builds the Invoker for a client
+// with interceptors, or returns nil if
+// there aren't any
+func (c *Client) chain() Invoker {
+	ic := c.cfg.intercept
+	if c.cfg.debug != nil {
+		ic = append(ic[:len(ic):len(ic)], c.debugCalls)
+	}
+	if len(ic) == 0 {
+		return nil
+	}
+	inv := Invoker(c.invoke)
+	for i := len(ic) - 1; i >= 0; i-- {
+		inv = ic[i](inv)
+	}
+	return inv
+}
+
+// invoke is the innermost Invoker.
+// the timeout is the one passed to
+// CallTimeout, if any, then the context's
+// deadline, then the client's default.
+func (c *Client) invoke(ctx context.Context, method Method, in msgp.Marshaler, out msgp.Unmarshaler) error {
+	timeout, ok := ctx.Value(timeoutKey{}).(time.Duration)
+	if !ok {
+		timeout = c.timeout
+		if d, ok := ctx.Deadline(); ok {
+			timeout = time.Until(d)
+			if timeout <= 0 {
+				return &CallError{Method: method, Addr: c.conn.RemoteAddr(), Err: context.DeadlineExceeded}
+			}
+		}
+	}
+	return c.call(ctx, method, in, out, timeout)
+}
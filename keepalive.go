@@ -0,0 +1,177 @@
+package synapse
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+// ErrKeepalive is the error returned to pending
+// calls when a connection is closed because the
+// other end stopped responding to keepalive pings.
+var ErrKeepalive = errors.New("synapse: peer stopped responding to keepalive pings")
+
+// Keepalive enables keepalive pings. When a
+// connection has been idle for 'interval',
+// a ping is sent to the other end, and if
+// 'misses' consecutive pings go unanswered,
+// the connection is closed. Pending client
+// calls fail with an error wrapping ErrKeepalive.
+// If 'misses' is less than 1, it is set to 3.
+//
+// Clients ping servers with the ping command.
+// Servers only ping clients that advertised
+// support for keepalive frames during the
+// handshake.
+func Keepalive(interval time.Duration, misses int) Option {
+	return func(c *config) {
+		if misses < 1 {
+			misses = 3
+		}
+		c.keepalive = interval
+		c.misses = misses
+	}
+}
+
+// RTT returns the round-trip time
+// of the most recent keepalive ping,
+// or 0 if no ping has completed.
+func (c *Client) RTT() time.Duration {
+	return time.Duration(atomic.LoadInt64(&c.rtt))
+}
+
+// keepaliveLoop pings the server whenever
+// the connection is idle. any frame from the
+// server counts as an answer to the last ping.
+func (c *Client) keepaliveLoop() {
+	tick := time.NewTicker(c.cfg.keepalive)
+	defer tick.Stop()
+	var sent int64 // time of outstanding ping, or 0
+	misses := 0
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-tick.C:
+		}
+		last := atomic.LoadInt64(&c.last)
+		if sent != 0 {
+			if last >= sent {
+				misses = 0
+			} else if misses++; misses >= c.cfg.misses {
+				c.closeError(ErrKeepalive)
+				return
+			}
+		}
+		now := time.Now()
+		if now.Sub(time.Unix(0, last)) < c.cfg.keepalive {
+			sent = 0
+			continue
+		}
+		sent = now.UnixNano()
+		go func() {
+			start := time.Now()
+			if c.ping() == nil {
+				atomic.StoreInt64(&c.rtt, int64(time.Since(start)))
+			}
+		}()
+	}
+}
+
+// pong answers a keepalive
+// ping from the server
+func (c *Client) pong(seq uint64) {
+	c.wg.Add(1)
+	if atomic.LoadUint32(&c.state) == clientClosed {
+		c.wg.Done()
+		return
+	}
+	w := c.waiters.pop(c)
+	if cap(w.in) < leadSize {
+		w.in = make([]byte, leadSize)
+	} else {
+		w.in = w.in[:leadSize]
+	}
+	// the write loop takes over our
+	// reference; nothing waits for a pong
+	putFrame(w.in, seq, fPONG, 0)
+	c.cfg.metrics.wrote(sideClient, leadSize)
+	c.writing <- w
+	c.wg.Done()
+}
+
+// startKeepalive starts pinging the
+// client if keepalive is enabled and
+// the client supports it. the returned
+// function stops the pings and waits for
+// the pinging goroutine to exit.
+func (c *connHandler) startKeepalive() (stop func()) {
+	if c.cfg.keepalive <= 0 {
+		return func() {}
+	}
+	done := make(chan struct{})
+	exited := make(chan struct{})
+	go func() {
+		c.keepaliveLoop(done)
+		close(exited)
+	}()
+	return func() {
+		close(done)
+		<-exited
+	}
+}
+
+func (c *connHandler) keepaliveLoop(done chan struct{}) {
+	tick := time.NewTicker(c.cfg.keepalive)
+	defer tick.Stop()
+	var seq uint64
+	var sent int64 // time of outstanding ping, or 0
+	misses := 0
+	for {
+		select {
+		case <-done:
+			return
+		case <-tick.C:
+		}
+		// the peer info isn't available
+		// until the handshake is done
+		if c.peerInfo().Frames&(1<<fPING) == 0 {
+			continue
+		}
+		last := atomic.LoadInt64(&c.last)
+		if sent != 0 {
+			if last >= sent {
+				misses = 0
+			} else if misses++; misses >= c.cfg.misses {
+				c.conn.Close()
+				return
+			}
+		}
+		now := time.Now()
+		if now.Sub(time.Unix(0, last)) < c.cfg.keepalive {
+			sent = 0
+			continue
+		}
+		sent = now.UnixNano()
+		seq++
+		wr := c.srv.wrappers.pop()
+		if cap(wr.res.out) < leadSize {
+			wr.res.out = make([]byte, leadSize)
+		} else {
+			wr.res.out = wr.res.out[:leadSize]
+		}
+		putFrame(wr.res.out, seq, fPING, 0)
+		atomic.StoreInt64(&c.pinged, sent)
+		c.cfg.metrics.wrote(sideServer, leadSize)
+		c.writing <- wr
+	}
+}
+
+// gotPong records the round-trip
+// time of a keepalive ping
+func (c *connHandler) gotPong() {
+	sent := atomic.LoadInt64(&c.pinged)
+	if sent != 0 {
+		atomic.StoreInt64(&c.rtt, time.Now().UnixNano()-sent)
+	}
+}
@@ -0,0 +1,91 @@
+package synapse
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// stallConn stops delivering
+// reads once stalled
+type stallConn struct {
+	net.Conn
+	once  sync.Once
+	stall chan struct{}
+	dead  chan struct{}
+}
+
+func newStallConn(c net.Conn) *stallConn {
+	return &stallConn{Conn: c, stall: make(chan struct{}), dead: make(chan struct{})}
+}
+
+func (s *stallConn) Read(b []byte) (int, error) {
+	n, err := s.Conn.Read(b)
+	select {
+	case <-s.stall:
+		<-s.dead
+		return 0, errors.New("closed")
+	default:
+		return n, err
+	}
+}
+
+func (s *stallConn) Close() error {
+	s.once.Do(func() { close(s.dead) })
+	return s.Conn.Close()
+}
+
+func TestKeepalive(t *testing.T) {
+	srv, cln := net.Pipe()
+	go ServeConn(srv, EchoHandler{}, Keepalive(time.Second, 2))
+	sc := newStallConn(cln)
+	cl, err := NewClient(sc, time.Minute, Keepalive(5*time.Millisecond, 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	if cl.RTT() == 0 {
+		t.Error("expected a keepalive round-trip time")
+	}
+
+	// stop reading responses; the pending
+	// call should fail long before the
+	// client's timeout
+	close(sc.stall)
+	start := time.Now()
+	in := testData("hello")
+	err = cl.Call(Echo, &in, nil)
+	if !errors.Is(err, ErrKeepalive) {
+		t.Fatalf("expected a keepalive error; got %v", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("keepalive took %s to fail the call", d)
+	}
+}
+
+// a healthy client should answer
+// the server's pings and stay connected
+func TestServerKeepalive(t *testing.T) {
+	srv, cln := net.Pipe()
+	s := NewServer(EchoHandler{}, Keepalive(2*time.Millisecond, 2))
+	go s.ServeConn(srv)
+	cl, err := NewClient(cln, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cl.Close()
+
+	time.Sleep(50 * time.Millisecond)
+	if st := s.State(); len(st.Connected) != 1 || st.Connected[0].RTT == 0 {
+		t.Errorf("expected a keepalive round-trip time; got %+v", st)
+	}
+	in := testData("hello")
+	var out testData
+	err = cl.Call(Echo, &in, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -78,29 +78,6 @@ func (n *mNode) size() (i int) {
 	return
 }
 
-// flush waiters marked with 'reap',
-// and mark unmarked waiters.
-func (n *mNode) reap() {
-	fwd := &n.list
-	var prev *waiter
-	for cur := n.list; cur != nil; {
-		if cur.reap {
-			if cur == n.tail {
-				n.tail = prev
-			}
-			*fwd, cur.next = cur.next, nil
-			cur.err = ErrTimeout
-			sema.Wake(&cur.done)
-			cur = *fwd
-		} else {
-			cur.reap = true
-			prev = cur
-			fwd = &cur.next
-			cur = cur.next
-		}
-	}
-}
-
 // flush the entire contents of the node
 func (n *mNode) flush(err error) {
 	var next *waiter
@@ -159,15 +136,3 @@ func (w *wMap) flush(err error) {
 		n.Unlock()
 	}
 }
-
-// reap carries out a timeout reap.
-// if (*waiter).reap==true, then delete it,
-// otherwise set (*waiter).reap to true.
-func (w *wMap) reap() {
-	for i := range w {
-		n := &w[i]
-		n.Lock()
-		n.reap()
-		n.Unlock()
-	}
-}
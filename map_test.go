@@ -55,22 +55,9 @@ func TestWaiterMap(t *testing.T) {
 		t.Errorf("expected 1000 elements after re-insertion; found %d", l)
 	}
 
-	mp.reap()
-
-	l = mp.length()
-	if l != 1000 {
-		t.Errorf("expected 1000 elements after first reap(); found %d", l)
-	}
-
-	mp.reap()
-
-	l = mp.length()
-	if l != 0 {
-		t.Errorf("expected 0 elements after second reap(); found %d", l)
-	}
+	mp.flush(nil)
 
 	for i := range vals {
-		vals[i].reap = false
 		mp.insert(&vals[i])
 	}
 
@@ -0,0 +1,108 @@
+package synapse
+
+import (
+	"context"
+
+	"github.com/tinylib/msgp/msgp"
+)
+
+// fMetadata is set in the frame type
+// of request frames whose body begins
+// with a metadata map
+const fMetadata fType = 0x40
+
+// Metadata is a set of key-value pairs
+// sent along with a request, like the
+// headers of an HTTP request. Metadata is
+// only sent to servers that support it
+// (see FeatureHeaders); otherwise it is
+// silently dropped.
+type Metadata map[string]string
+
+type metadataKey struct{}
+
+// WithMetadata returns a copy of 'ctx'
+// carrying 'md', merged with any metadata
+// already in 'ctx'. Calls made with
+// (*Client).CallContext send the metadata
+// in their context.
+func WithMetadata(ctx context.Context, md Metadata) context.Context {
+	old := MetadataFromContext(ctx)
+	if len(old) == 0 {
+		return context.WithValue(ctx, metadataKey{}, md)
+	}
+	merged := make(Metadata, len(old)+len(md))
+	for k, v := range old {
+		merged[k] = v
+	}
+	for k, v := range md {
+		merged[k] = v
+	}
+	return context.WithValue(ctx, metadataKey{}, merged)
+}
+
+// MetadataFromContext returns the metadata
+// in 'ctx', or nil if there isn't any.
+// The returned map must not be modified.
+func MetadataFromContext(ctx context.Context) Metadata {
+	md, _ := ctx.Value(metadataKey{}).(Metadata)
+	return md
+}
+
+// RequestMetadata returns the metadata
+// sent with a request, or nil if there
+// isn't any. A Request has metadata if it
+// has a method
+//
+//  Metadata() Metadata
+//
+// The Request passed to handlers by this
+// package has one. The returned map must
+// not be modified.
+func RequestMetadata(req Request) Metadata {
+	if r, ok := req.(interface {
+		Metadata() Metadata
+	}); ok {
+		return r.Metadata()
+	}
+	return nil
+}
+
+// appendMetadata appends 'md'
+// as a map of strings to strings
+func appendMetadata(b []byte, md Metadata) []byte {
+	b = msgp.AppendMapHeader(b, uint32(len(md)))
+	for k, v := range md {
+		b = msgp.AppendString(b, k)
+		b = msgp.AppendString(b, v)
+	}
+	return b
+}
+
+// readMetadata reads a metadata map
+// from the front of 'b' and returns the
+// remaining bytes
+func readMetadata(b []byte) (Metadata, []byte, error) {
+	sz, b, err := msgp.ReadMapHeaderBytes(b)
+	if err != nil {
+		return nil, b, err
+	}
+	// every entry takes at least two bytes
+	if uint64(sz) > uint64(len(b))/2 {
+		return nil, b, msgp.ErrShortBytes
+	}
+	md := make(Metadata, sz)
+	for ; sz > 0; sz-- {
+		var k, v string
+		k, b, err = msgp.ReadStringBytes(b)
+		if err != nil {
+			return nil, b, err
+		}
+		v, b, err = msgp.ReadStringBytes(b)
+		if err != nil {
+			return nil, b, err
+		}
+		md[k] = v
+	}
+	return md, b, nil
+}
@@ -0,0 +1,117 @@
+package synapse
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/tinylib/msgp/msgp"
+)
+
+// responds with the value of
+// the "key" metadata
+type mdHandler struct{}
+
+func (mdHandler) ServeCall(req Request, res ResponseWriter) {
+	res.Send(msgp.Raw(msgp.AppendString(nil, RequestMetadata(req)["key"])))
+}
+
+func TestMetadata(t *testing.T) {
+	ctx := WithMetadata(context.Background(), Metadata{"key": "old", "other": "x"})
+	ctx = WithMetadata(ctx, Metadata{"key": "value"})
+	if md := MetadataFromContext(ctx); md["key"] != "value" || md["other"] != "x" {
+		t.Fatalf("metadata wasn't merged: %v", md)
+	}
+
+	opts := map[string][]Option{
+		"plain":      nil,
+		"compressed": {Compression(1)},
+	}
+	for name, o := range opts {
+		srv, cln := net.Pipe()
+		go ServeConn(srv, mdHandler{}, o...)
+		cl, err := NewClient(cln, time.Second, o...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !cl.Features().Has(FeatureHeaders) {
+			t.Errorf("%s: headers not negotiated", name)
+		}
+
+		var out testString
+		if err := cl.CallContext(ctx, Echo, nil, &out); err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		if out != "value" {
+			t.Errorf("%s: server saw metadata %q", name, out)
+		}
+
+		// no metadata
+		out = ""
+		if err := cl.Call(Echo, nil, &out); err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		if out != "" {
+			t.Errorf("%s: server saw metadata %q", name, out)
+		}
+		cl.Close()
+	}
+}
+
+type testString string
+
+func (s *testString) MarshalMsg(b []byte) ([]byte, error) {
+	return msgp.AppendString(b, string(*s)), nil
+}
+
+func (s *testString) UnmarshalMsg(b []byte) ([]byte, error) {
+	str, b, err := msgp.ReadStringBytes(b)
+	*s = testString(str)
+	return b, err
+}
+
+func TestCallContext(t *testing.T) {
+	block := make(chan struct{})
+	h := HandlerFunc(func(req Request, res ResponseWriter) {
+		<-block
+		res.Send(nil)
+	})
+	srv, cln := net.Pipe()
+	go ServeConn(srv, h)
+	cl, err := NewClient(cln, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cl.Close()
+	defer close(block)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+	err = cl.CallContext(ctx, Echo, nil, nil)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled; got %v", err)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err = cl.CallContext(ctx, Echo, nil, nil)
+	if !errors.Is(err, ErrTimeout) && !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected a timeout; got %v", err)
+	}
+	if time.Since(start) > 500*time.Millisecond {
+		t.Errorf("call took %s; expected about 10ms", time.Since(start))
+	}
+}
+
+func TestMetadataSize(t *testing.T) {
+	b := msgp.AppendMapHeader(nil, 1<<31)
+	if _, _, err := readMetadata(b); err != msgp.ErrShortBytes {
+		t.Errorf("expected %v; got %v", msgp.ErrShortBytes, err)
+	}
+}
@@ -0,0 +1,135 @@
+package synapse
+
+import (
+	"fmt"
+
+	"github.com/tinylib/msgp/msgp"
+)
+
+// MethodInfo describes a method
+// exposed by a server.
+type MethodInfo struct {
+	ID     Method // method number
+	Name   string // name, if known
+	Schema string // description of the method's types, if known
+}
+
+// MethodLister is implemented by Handlers
+// that can list the methods they serve.
+// Servers use it to answer (*Client).Methods.
+type MethodLister interface {
+	Methods() []MethodInfo
+}
+
+// Describer can be implemented by
+// individual handlers in a RouteTable
+// in order to supply the schema of
+// the method they serve.
+type Describer interface {
+	Describe() string
+}
+
+// HandlerMethods returns the methods
+// exposed by 'h', or nil if 'h' doesn't
+// implement MethodLister.
+func HandlerMethods(h Handler) []MethodInfo {
+	if l, ok := h.(MethodLister); ok {
+		return l.Methods()
+	}
+	return nil
+}
+
+// Methods implements MethodLister. Method
+// names are the ones set with RegisterName.
+func (r *RouteTable) Methods() []MethodInfo {
+	var out []MethodInfo
+	for i, h := range *r {
+		if h == nil {
+			continue
+		}
+		mi := MethodInfo{ID: Method(i), Name: methodTab[Method(i)]}
+		if d, ok := h.(Describer); ok {
+			mi.Schema = d.Describe()
+		}
+		out = append(out, mi)
+	}
+	return out
+}
+
+// Methods implements MethodLister
+func (s *Service) Methods() []MethodInfo {
+	out := make([]MethodInfo, len(s.methods))
+	for i := range s.methods {
+		sm := &s.methods[i]
+		out[i] = MethodInfo{
+			ID:     Method(i),
+			Name:   sm.name,
+			Schema: fmt.Sprintf("func(%s) %s", sm.in, sm.out),
+		}
+	}
+	return out
+}
+
+// methodList is the wire representation
+// of the response to cmdListMethods. Each
+// method is encoded as a map so that fields
+// can be added later.
+type methodList []MethodInfo
+
+func (m methodList) MarshalMsg(b []byte) ([]byte, error) {
+	b = msgp.AppendArrayHeader(b, uint32(len(m)))
+	for i := range m {
+		b = msgp.AppendMapHeader(b, 3)
+		b = msgp.AppendString(b, "id")
+		b = msgp.AppendUint32(b, uint32(m[i].ID))
+		b = msgp.AppendString(b, "name")
+		b = msgp.AppendString(b, m[i].Name)
+		b = msgp.AppendString(b, "schema")
+		b = msgp.AppendString(b, m[i].Schema)
+	}
+	return b, nil
+}
+
+func (m *methodList) UnmarshalMsg(b []byte) ([]byte, error) {
+	sz, b, err := msgp.ReadArrayHeaderBytes(b)
+	if err != nil {
+		return b, err
+	}
+	// each entry takes at least one byte, so
+	// don't trust a size larger than the input
+	if uint64(sz) > uint64(len(b)) {
+		return b, msgp.ErrShortBytes
+	}
+	out := make(methodList, sz)
+	for i := range out {
+		var fields uint32
+		fields, b, err = msgp.ReadMapHeaderBytes(b)
+		if err != nil {
+			return b, err
+		}
+		for ; fields > 0; fields-- {
+			var key []byte
+			key, b, err = msgp.ReadMapKeyZC(b)
+			if err != nil {
+				return b, err
+			}
+			switch msgp.UnsafeString(key) {
+			case "id":
+				var id uint32
+				id, b, err = msgp.ReadUint32Bytes(b)
+				out[i].ID = Method(id)
+			case "name":
+				out[i].Name, b, err = msgp.ReadStringBytes(b)
+			case "schema":
+				out[i].Schema, b, err = msgp.ReadStringBytes(b)
+			default:
+				b, err = msgp.Skip(b)
+			}
+			if err != nil {
+				return b, err
+			}
+		}
+	}
+	*m = out
+	return b, nil
+}
@@ -0,0 +1,412 @@
+package synapse
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tinylib/msgp/msgp"
+)
+
+// Metrics collects statistics about the
+// traffic handled by clients and servers,
+// and exports them in the Prometheus text
+// exposition format. A Metrics is attached
+// to clients and servers with Instrument, and
+// it can be shared between any number of them.
+// The zero value is not usable; use NewMetrics.
+//
+// Metrics implements http.Handler, so it can
+// be mounted on an HTTP server:
+//
+//  m := synapse.NewMetrics()
+//  http.Handle("/metrics", m)
+//  go synapse.ListenAndServe("tcp", ":7000", h, synapse.Instrument(m))
+//
+type Metrics struct {
+	lock     sync.RWMutex
+	requests map[reqKey]*uint64
+	latency  map[latKey]*histogram
+	sides    [2]sideStats
+}
+
+// NewMetrics returns a new, empty Metrics.
+func NewMetrics() *Metrics {
+	return &Metrics{
+		requests: make(map[reqKey]*uint64),
+		latency:  make(map[latKey]*histogram),
+	}
+}
+
+// Instrument makes a client or server
+// record statistics in 'm'. Servers count
+// calls to methods without a name set
+// with RegisterName under the method
+// label "other".
+func Instrument(m *Metrics) Option {
+	return func(c *config) {
+		c.metrics = m
+	}
+}
+
+// side is the label
+// for client or server
+// statistics
+type side int
+
+const (
+	sideClient side = iota
+	sideServer
+)
+
+func (s side) String() string {
+	if s == sideClient {
+		return "client"
+	}
+	return "server"
+}
+
+// per-side counters
+type sideStats struct {
+	inflight   int64  // requests in progress
+	conns      int64  // open connections
+	connsTotal uint64 // connections opened
+	bytesIn    uint64 // frame bytes read
+	bytesOut   uint64 // frame bytes written
+	timeouts   uint64 // client timeouts
+}
+
+// mlabel is the method label of a
+// series. on the server side, methods
+// without a name set with RegisterName
+// share the label "other", so that
+// clients can't create an unbounded
+// number of series.
+type mlabel struct {
+	method Method
+	other  bool
+}
+
+func methodLabel(s side, m Method) mlabel {
+	if s == sideServer {
+		if _, ok := methodTab[m]; !ok {
+			return mlabel{other: true}
+		}
+	}
+	return mlabel{method: m}
+}
+
+func (l mlabel) String() string {
+	if l.other {
+		return "other"
+	}
+	return l.method.String()
+}
+
+// "other" sorts last
+func (l mlabel) less(o mlabel) bool {
+	if l.other != o.other {
+		return o.other
+	}
+	return l.method < o.method
+}
+
+type reqKey struct {
+	side   side
+	method mlabel
+	status Status
+}
+
+type latKey struct {
+	side   side
+	method mlabel
+}
+
+// upper bounds of the latency
+// histogram buckets
+var latencyBuckets = [...]time.Duration{
+	100 * time.Microsecond,
+	250 * time.Microsecond,
+	500 * time.Microsecond,
+	time.Millisecond,
+	2500 * time.Microsecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2500 * time.Millisecond,
+	5 * time.Second,
+	10 * time.Second,
+}
+
+// histogram is a latency histogram.
+// counts are per-bucket, not cumulative;
+// the last bucket is +Inf.
+type histogram struct {
+	counts [len(latencyBuckets) + 1]uint64
+	sum    int64 // nanoseconds
+}
+
+func (h *histogram) observe(d time.Duration) {
+	i := sort.Search(len(latencyBuckets), func(i int) bool {
+		return d <= latencyBuckets[i]
+	})
+	atomic.AddUint64(&h.counts[i], 1)
+	atomic.AddInt64(&h.sum, int64(d))
+}
+
+// the following methods are
+// all no-ops on a nil *Metrics
+
+func (m *Metrics) connOpened(s side) {
+	if m == nil {
+		return
+	}
+	atomic.AddInt64(&m.sides[s].conns, 1)
+	atomic.AddUint64(&m.sides[s].connsTotal, 1)
+}
+
+func (m *Metrics) connClosed(s side) {
+	if m == nil {
+		return
+	}
+	atomic.AddInt64(&m.sides[s].conns, -1)
+}
+
+func (m *Metrics) read(s side, n int) {
+	if m == nil {
+		return
+	}
+	atomic.AddUint64(&m.sides[s].bytesIn, uint64(n))
+}
+
+func (m *Metrics) wrote(s side, n int) {
+	if m == nil {
+		return
+	}
+	atomic.AddUint64(&m.sides[s].bytesOut, uint64(n))
+}
+
+// start records a request
+// as in progress
+func (m *Metrics) start(s side) {
+	if m == nil {
+		return
+	}
+	atomic.AddInt64(&m.sides[s].inflight, 1)
+}
+
+// finish records the result of
+// a request passed to start
+func (m *Metrics) finish(s side, mtd Method, status Status, elapsed time.Duration) {
+	if m == nil {
+		return
+	}
+	atomic.AddInt64(&m.sides[s].inflight, -1)
+	l := methodLabel(s, mtd)
+	atomic.AddUint64(m.counter(reqKey{s, l, status}), 1)
+	m.histogram(latKey{s, l}).observe(elapsed)
+}
+
+func (m *Metrics) timeout(s side) {
+	if m == nil {
+		return
+	}
+	atomic.AddUint64(&m.sides[s].timeouts, 1)
+}
+
+func (m *Metrics) counter(k reqKey) *uint64 {
+	m.lock.RLock()
+	c, ok := m.requests[k]
+	m.lock.RUnlock()
+	if ok {
+		return c
+	}
+	m.lock.Lock()
+	c, ok = m.requests[k]
+	if !ok {
+		c = new(uint64)
+		m.requests[k] = c
+	}
+	m.lock.Unlock()
+	return c
+}
+
+func (m *Metrics) histogram(k latKey) *histogram {
+	m.lock.RLock()
+	h, ok := m.latency[k]
+	m.lock.RUnlock()
+	if ok {
+		return h
+	}
+	m.lock.Lock()
+	h, ok = m.latency[k]
+	if !ok {
+		h = new(histogram)
+		m.latency[k] = h
+	}
+	m.lock.Unlock()
+	return h
+}
+
+// callStatus returns the status
+// recorded for a client call
+func callStatus(err error) Status {
+	if err == nil {
+		return StatusOK
+	}
+	var re *ResponseError
+	if errors.As(err, &re) {
+		return re.Code
+	}
+	if errors.Is(err, ErrTimeout) || errors.Is(err, context.DeadlineExceeded) {
+		return StatusTimeout
+	}
+	if errors.Is(err, context.Canceled) {
+		return StatusCancelled
+	}
+	return StatusOther
+}
+
+// responseStatus returns the status
+// code of a framed response
+func responseStatus(out []byte) Status {
+	if len(out) < leadSize {
+		return StatusInvalid
+	}
+	code, _, err := msgp.ReadIntBytes(out[leadSize:])
+	if err != nil {
+		return StatusInvalid
+	}
+	return Status(code)
+}
+
+// ServeHTTP implements http.Handler by
+// writing the metrics in the text
+// exposition format.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.WriteTo(w)
+}
+
+// WriteTo writes the metrics to 'w'
+// in the text exposition format.
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	cw := &countWriter{w: w}
+	bw := bufio.NewWriter(cw)
+
+	m.lock.RLock()
+	reqs := make([]reqKey, 0, len(m.requests))
+	for k := range m.requests {
+		reqs = append(reqs, k)
+	}
+	lats := make([]latKey, 0, len(m.latency))
+	for k := range m.latency {
+		lats = append(lats, k)
+	}
+	m.lock.RUnlock()
+
+	sort.Slice(reqs, func(i, j int) bool {
+		a, b := reqs[i], reqs[j]
+		if a.side != b.side {
+			return a.side < b.side
+		}
+		if a.method != b.method {
+			return a.method.less(b.method)
+		}
+		return a.status < b.status
+	})
+	sort.Slice(lats, func(i, j int) bool {
+		a, b := lats[i], lats[j]
+		if a.side != b.side {
+			return a.side < b.side
+		}
+		return a.method.less(b.method)
+	})
+
+	header(bw, "synapse_requests_total", "counter", "Requests completed, by method and status.")
+	for _, k := range reqs {
+		fmt.Fprintf(bw, "synapse_requests_total{side=%q,method=%s,status=%s} %d\n",
+			k.side, quote(k.method.String()), quote(k.status.String()), atomic.LoadUint64(m.counter(k)))
+	}
+
+	header(bw, "synapse_request_duration_seconds", "histogram", "Request latency, by method.")
+	for _, k := range lats {
+		h := m.histogram(k)
+		labels := fmt.Sprintf("side=%q,method=%s", k.side, quote(k.method.String()))
+		var total uint64
+		for i := range h.counts {
+			total += atomic.LoadUint64(&h.counts[i])
+			le := "+Inf"
+			if i < len(latencyBuckets) {
+				le = strconv.FormatFloat(latencyBuckets[i].Seconds(), 'g', -1, 64)
+			}
+			fmt.Fprintf(bw, "synapse_request_duration_seconds_bucket{%s,le=%q} %d\n", labels, le, total)
+		}
+		sum := time.Duration(atomic.LoadInt64(&h.sum)).Seconds()
+		fmt.Fprintf(bw, "synapse_request_duration_seconds_sum{%s} %g\n", labels, sum)
+		fmt.Fprintf(bw, "synapse_request_duration_seconds_count{%s} %d\n", labels, total)
+	}
+
+	perSide := []struct {
+		name, typ, help string
+		val             func(s *sideStats) string
+	}{
+		{"synapse_requests_in_flight", "gauge", "Requests in progress.",
+			func(s *sideStats) string { return strconv.FormatInt(atomic.LoadInt64(&s.inflight), 10) }},
+		{"synapse_connections", "gauge", "Open connections.",
+			func(s *sideStats) string { return strconv.FormatInt(atomic.LoadInt64(&s.conns), 10) }},
+		{"synapse_connections_total", "counter", "Connections opened.",
+			func(s *sideStats) string { return strconv.FormatUint(atomic.LoadUint64(&s.connsTotal), 10) }},
+		{"synapse_received_bytes_total", "counter", "Bytes of frames received.",
+			func(s *sideStats) string { return strconv.FormatUint(atomic.LoadUint64(&s.bytesIn), 10) }},
+		{"synapse_sent_bytes_total", "counter", "Bytes of frames sent.",
+			func(s *sideStats) string { return strconv.FormatUint(atomic.LoadUint64(&s.bytesOut), 10) }},
+		{"synapse_timeouts_total", "counter", "Client calls that timed out.",
+			func(s *sideStats) string { return strconv.FormatUint(atomic.LoadUint64(&s.timeouts), 10) }},
+	}
+	for _, p := range perSide {
+		header(bw, p.name, p.typ, p.help)
+		for s := range m.sides {
+			fmt.Fprintf(bw, "%s{side=%q} %s\n", p.name, side(s), p.val(&m.sides[s]))
+		}
+	}
+
+	err := bw.Flush()
+	return cw.n, err
+}
+
+func header(w io.Writer, name, typ, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// labelEscaper escapes label values
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func quote(s string) string {
+	return `"` + labelEscaper.Replace(s) + `"`
+}
+
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
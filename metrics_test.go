@@ -0,0 +1,107 @@
+package synapse
+
+import (
+	"bytes"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetrics(t *testing.T) {
+	m := NewMetrics()
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sleep := HandlerFunc(func(req Request, res ResponseWriter) {
+		time.Sleep(50 * time.Millisecond)
+		res.Send(nil)
+	})
+	rt := &RouteTable{Echo: EchoHandler{}, Nop: sleep, Fail: FailHandler{}}
+	go Serve(l, rt, Instrument(m))
+
+	cl, err := Dial("tcp", l.Addr().String(), time.Second, Instrument(m))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	in := testData("hello")
+	for i := 0; i < 3; i++ {
+		if err := cl.Call(Echo, &in, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// fails on both sides
+	if err := cl.Call(Fail, nil, nil); err == nil {
+		t.Fatal("expected an error")
+	}
+	// times out on the client
+	if err := cl.CallTimeout(Nop, nil, nil, time.Millisecond); err == nil {
+		t.Fatal("expected a timeout")
+	}
+	// unregistered methods share one
+	// label on the server
+	for _, mtd := range []Method{1000, 1001} {
+		if err := cl.Call(mtd, nil, nil); err == nil {
+			t.Fatal("expected an error")
+		}
+	}
+	cl.Close()
+	l.Close()
+
+	// wait for the server to finish
+	// up the sleep handler
+	var out string
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		var buf bytes.Buffer
+		m.WriteTo(&buf)
+		out = buf.String()
+		if strings.Contains(out, `synapse_requests_in_flight{side="server"} 0`) &&
+			strings.Contains(out, `synapse_connections{side="server"} 0`) || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	for _, want := range []string{
+		`synapse_requests_total{side="client",method="echo",status="OK"} 3`,
+		`synapse_requests_total{side="server",method="echo",status="OK"} 3`,
+		`synapse_requests_total{side="client",method="fail",status="server error"} 1`,
+		`synapse_requests_total{side="server",method="fail",status="server error"} 1`,
+		`synapse_requests_total{side="client",method="nop",status="timeout"} 1`,
+		`synapse_requests_total{side="client",method="Method(1000)",status="not found"} 1`,
+		`synapse_requests_total{side="server",method="other",status="not found"} 2`,
+		`synapse_request_duration_seconds_count{side="client",method="echo"} 3`,
+		`synapse_request_duration_seconds_bucket{side="server",method="echo",le="+Inf"} 3`,
+		`synapse_requests_in_flight{side="client"} 0`,
+		`synapse_requests_in_flight{side="server"} 0`,
+		`synapse_connections{side="client"} 0`,
+		`synapse_connections_total{side="client"} 1`,
+		`synapse_connections_total{side="server"} 1`,
+		`synapse_timeouts_total{side="client"} 1`,
+		"# TYPE synapse_request_duration_seconds histogram",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output doesn't contain %s", want)
+		}
+	}
+	if strings.Contains(out, `synapse_sent_bytes_total{side="client"} 0`) ||
+		strings.Contains(out, `synapse_received_bytes_total{side="server"} 0`) {
+		t.Error("expected byte counts")
+	}
+	if t.Failed() {
+		t.Log(out)
+	}
+
+	rec := httptest.NewRecorder()
+	m.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+		t.Errorf("unexpected content type %q", ct)
+	}
+	if rec.Body.String() != out {
+		t.Error("ServeHTTP and WriteTo disagree")
+	}
+}
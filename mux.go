@@ -13,7 +13,7 @@ type RouteTable []Handler
 
 func (r *RouteTable) ServeCall(req Request, res ResponseWriter) {
 	m := req.Method()
-	if int(m) > len(*r) {
+	if int(m) >= len(*r) {
 		res.Error(StatusNotFound, "no such method")
 		return
 	}
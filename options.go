@@ -0,0 +1,42 @@
+package synapse
+
+import (
+	"time"
+)
+
+// An Option configures a Client or a
+// server. Options are passed to Dial,
+// DialTLS and NewClient on the client
+// side, and to Serve, ServeConn and the
+// ListenAndServe functions on the server
+// side. Unless otherwise noted, an Option
+// applies to both sides.
+type Option func(*config)
+
+// config is the set of
+// options for one end of
+// a connection
+type config struct {
+	features   Features      // optional features to advertise
+	threshold  int           // minimum body size for compression
+	keepalive  time.Duration // idle time before pinging; 0 disables
+	misses     int           // unanswered pings before closing
+	poolSize   int           // object pool capacity
+	poolSet    bool          // poolSize was set
+	exec       ExecMode      // how requests are executed (server only)
+	workers    int           // number of workers for WorkerPool
+	vector     int           // minimum frame size for vectored writes; 0 disables them
+	metrics    *Metrics      // statistics; may be nil
+	intercept  []Interceptor // client interceptors
+	debug      *debugLog     // set by DebugCalls
+	inline     int           // largest request run inline in Inline mode
+	inlineSet  bool          // inline was set
+	introspect bool          // enables the state command (server only)
+	inspectors []Verifier    // callers allowed to use the state command
+}
+
+func (c *config) apply(opts []Option) {
+	for _, o := range opts {
+		o(c)
+	}
+}
@@ -0,0 +1,76 @@
+package synapse
+
+import (
+	"sync/atomic"
+)
+
+// defaultPoolSize is the default
+// capacity of object pools
+const defaultPoolSize = 512
+
+// PoolSize sets the maximum number of idle
+// objects kept for re-use by a Client (one
+// per call in progress) or a Server (one per
+// request in progress). Pools are empty to
+// begin with, so they only use memory in
+// proportion to the peak number of concurrent
+// requests. A size of 0 disables pooling.
+// The default is 512.
+func PoolSize(n int) Option {
+	return func(c *config) {
+		if n < 0 {
+			n = 0
+		}
+		c.poolSize = n
+		c.poolSet = true
+	}
+}
+
+// pool returns the configured pool size
+func (c *config) pool() int {
+	if !c.poolSet {
+		return defaultPoolSize
+	}
+	return c.poolSize
+}
+
+// PoolStats reports on the use of
+// an object pool.
+type PoolStats struct {
+	Hits   uint64 // objects re-used from the pool
+	Misses uint64 // objects allocated because the pool was empty
+	Drops  uint64 // objects discarded because the pool was full
+	Idle   int    // objects currently in the pool
+	Cap    int    // maximum number of idle objects
+}
+
+// pool counters
+type poolStats struct {
+	hits, misses, drops uint64
+}
+
+func (p *poolStats) load() poolStats {
+	return poolStats{
+		hits:   atomic.LoadUint64(&p.hits),
+		misses: atomic.LoadUint64(&p.misses),
+		drops:  atomic.LoadUint64(&p.drops),
+	}
+}
+
+func (p poolStats) export(idle, max int) PoolStats {
+	return PoolStats{
+		Hits:   p.hits,
+		Misses: p.misses,
+		Drops:  p.drops,
+		Idle:   idle,
+		Cap:    max,
+	}
+}
+
+// PoolStats returns statistics about
+// the client's pool of call state.
+func (c *Client) PoolStats() PoolStats { return c.waiters.stat() }
+
+// PoolStats returns statistics about
+// the server's pool of request state.
+func (s *Server) PoolStats() PoolStats { return s.wrappers.stat() }
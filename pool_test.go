@@ -0,0 +1,83 @@
+package synapse
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestPoolStats(t *testing.T) {
+	srv := NewServer(EchoHandler{}, PoolSize(0))
+	sc, cc := net.Pipe()
+	go srv.ServeConn(sc)
+	cl, err := NewClient(cc, time.Second, PoolSize(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cl.Close()
+
+	const calls = 10
+	in := testData("hello")
+	for i := 0; i < calls; i++ {
+		err = cl.Call(Echo, &in, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cs := cl.PoolStats()
+	if cs.Cap != 4 {
+		t.Errorf("expected client pool capacity 4; got %d", cs.Cap)
+	}
+	if cs.Hits+cs.Misses < calls {
+		t.Errorf("expected at least %d pool gets; got %d", calls, cs.Hits+cs.Misses)
+	}
+	if cs.Idle > cs.Cap {
+		t.Errorf("pool has %d idle objects; capacity is %d", cs.Idle, cs.Cap)
+	}
+
+	ss := srv.PoolStats()
+	if ss.Cap != 0 || ss.Idle != 0 || ss.Hits != 0 {
+		t.Errorf("expected disabled server pool; got %+v", ss)
+	}
+	if ss.Drops < calls {
+		t.Errorf("expected at least %d drops; got %d", calls, ss.Drops)
+	}
+}
+
+// calls that fail after their requests
+// are written still return their waiters
+func TestPoolFailedCalls(t *testing.T) {
+	stuck := make(chan struct{})
+	defer close(stuck)
+	h := HandlerFunc(func(req Request, res ResponseWriter) {
+		<-stuck
+	})
+	sc, cc := net.Pipe()
+	go ServeConn(sc, h)
+	cl, err := NewClient(cc, 10*time.Millisecond, PoolSize(16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cl.Close()
+
+	for i := 0; i < 10; i++ {
+		if err := cl.Call(Echo, nil, nil); !errors.Is(err, ErrTimeout) {
+			t.Fatalf("expected %v; got %v", ErrTimeout, err)
+		}
+	}
+	deadline := time.Now().Add(time.Second)
+	for {
+		// every waiter allocated is
+		// either idle or dropped
+		s := cl.PoolStats()
+		if s.Misses == uint64(s.Idle)+s.Drops {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("waiters were not returned to the pool: %+v", s)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
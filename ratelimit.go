@@ -0,0 +1,242 @@
+package synapse
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"sync"
+	"time"
+)
+
+// Limit is the rate and burst
+// size of a token bucket.
+type Limit struct {
+	// Rate is the number of calls
+	// allowed per second. A Rate of
+	// zero or less means no limit.
+	Rate float64
+
+	// Burst is the number of calls
+	// that can be made at once. It
+	// is at least 1.
+	Burst int
+}
+
+// A RateKey returns the key used to
+// rate-limit a request. Requests with
+// the same key share a bucket.
+type RateKey func(req Request) string
+
+// RateLimitOptions configures RateLimit.
+type RateLimitOptions struct {
+	// Limit applies to every
+	// method not in Methods. Calls
+	// with the same key share one
+	// bucket across those methods.
+	Limit Limit
+
+	// Methods overrides Limit for
+	// individual methods. Each of
+	// these methods has its own
+	// bucket for each key.
+	Methods map[Method]Limit
+
+	// Key, if non-nil, splits the buckets
+	// by a property of the request, like
+	// KeyRemoteAddr or KeyIdentity. If Key
+	// is nil, every caller shares the same
+	// buckets.
+	Key RateKey
+
+	// Idle is how long a bucket must go
+	// unused before it is forgotten. Buckets
+	// are only forgotten once they have
+	// refilled, so forgetting them never
+	// allows extra calls. The default is
+	// one minute.
+	Idle time.Duration
+}
+
+// RateLimit returns a Middleware that limits
+// the rate of calls with token buckets. Calls
+// over the limit are rejected with
+// StatusOverloaded, and the ResponseError
+// sent to the client has Retryable set and a
+// RetryAfter of the time until the call
+// would have been allowed.
+//
+// For example, to allow each remote host
+// 100 calls per second, and 1 call per
+// second to method 'Expensive':
+//
+//  RateLimit(RateLimitOptions{
+//      Limit:   Limit{Rate: 100, Burst: 10},
+//      Methods: map[Method]Limit{Expensive: {Rate: 1, Burst: 1}},
+//      Key:     KeyRemoteAddr,
+//  })
+//
+func RateLimit(opts RateLimitOptions) Middleware {
+	if opts.Idle <= 0 {
+		opts.Idle = time.Minute
+	}
+	return func(h Handler) Handler {
+		return &limiter{
+			inner:   h,
+			opts:    opts,
+			buckets: make(map[bucketKey]*bucket),
+			swept:   time.Now(),
+		}
+	}
+}
+
+// KeyRemoteAddr is a RateKey that
+// limits requests by the host part
+// of their remote address.
+func KeyRemoteAddr(req Request) string {
+	addr := addrString(req)
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+// KeyContext returns a RateKey that
+// limits requests by the value of 'key'
+// in their context (see RequestContext),
+// which is typically an identity set by
+// an authentication middleware. Requests
+// without a value share one bucket.
+func KeyContext(key interface{}) RateKey {
+	return func(req Request) string {
+		switch v := RequestContext(req).Value(key).(type) {
+		case nil:
+			return ""
+		case string:
+			return v
+		case fmt.Stringer:
+			return v.String()
+		default:
+			return fmt.Sprint(v)
+		}
+	}
+}
+
+// KeyIdentity is a RateKey that limits
+// requests by the identity set by
+// Authenticate. Requests without an
+// identity share one bucket.
+func KeyIdentity(req Request) string {
+	id, _ := RequestIdentity(req)
+	return id.Scheme + ":" + id.Subject
+}
+
+// bucketKey identifies a bucket. 'method'
+// is only set for methods in Methods
+type bucketKey struct {
+	method Method
+	shared bool // uses opts.Limit
+	key    string
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// take takes a token from the bucket, or
+// returns how long to wait for one
+func (b *bucket) take(l Limit, now time.Time) (bool, time.Duration) {
+	b.refill(l, now)
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	wait := (1 - b.tokens) / l.Rate
+	return false, time.Duration(math.Ceil(wait * float64(time.Second)))
+}
+
+func (b *bucket) refill(l Limit, now time.Time) {
+	b.tokens = math.Min(burst(l), b.tokens+now.Sub(b.last).Seconds()*l.Rate)
+	b.last = now
+}
+
+func burst(l Limit) float64 {
+	if l.Burst < 1 {
+		return 1
+	}
+	return float64(l.Burst)
+}
+
+type limiter struct {
+	inner   Handler
+	opts    RateLimitOptions
+	lock    sync.Mutex
+	buckets map[bucketKey]*bucket
+	swept   time.Time // time of the last eviction pass
+}
+
+// Methods implements MethodLister
+// if the wrapped handler does.
+func (l *limiter) Methods() []MethodInfo { return HandlerMethods(l.inner) }
+
+func (l *limiter) ServeCall(req Request, res ResponseWriter) {
+	m := req.Method()
+	lim, ok := l.opts.Methods[m]
+	bk := bucketKey{method: m}
+	if !ok {
+		lim = l.opts.Limit
+		bk = bucketKey{shared: true}
+	}
+	if lim.Rate <= 0 {
+		l.inner.ServeCall(req, res)
+		return
+	}
+	if l.opts.Key != nil {
+		bk.key = l.opts.Key(req)
+	}
+	if ok, wait := l.take(bk, lim); !ok {
+		SendError(res, &ResponseError{
+			Code:       StatusOverloaded,
+			Expl:       "rate limit exceeded",
+			Retryable:  true,
+			RetryAfter: wait,
+		})
+		return
+	}
+	l.inner.ServeCall(req, res)
+}
+
+func (l *limiter) take(k bucketKey, lim Limit) (bool, time.Duration) {
+	now := time.Now()
+	l.lock.Lock()
+	if now.Sub(l.swept) >= l.opts.Idle {
+		l.sweep(now)
+	}
+	b, ok := l.buckets[k]
+	if !ok {
+		b = &bucket{tokens: burst(lim), last: now}
+		l.buckets[k] = b
+	}
+	ok, wait := b.take(lim, now)
+	l.lock.Unlock()
+	return ok, wait
+}
+
+// sweep forgets the buckets that
+// have been idle and are full
+func (l *limiter) sweep(now time.Time) {
+	for k, b := range l.buckets {
+		if now.Sub(b.last) < l.opts.Idle {
+			continue
+		}
+		lim := l.opts.Limit
+		if !k.shared {
+			lim = l.opts.Methods[k.method]
+		}
+		b.refill(lim, now)
+		if b.tokens >= burst(lim) {
+			delete(l.buckets, k)
+		}
+	}
+	l.swept = now
+}
@@ -0,0 +1,95 @@
+package synapse
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRateLimit(t *testing.T) {
+	h := RateLimit(RateLimitOptions{
+		Methods: map[Method]Limit{Echo: {Rate: 1.0 / 3600, Burst: 2}},
+	})(&RouteTable{Echo: EchoHandler{}, Nop: NopHandler{}})
+	srv, cln := net.Pipe()
+	go ServeConn(srv, h)
+	cl, err := NewClient(cln, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cl.Close()
+
+	for i := 0; i < 2; i++ {
+		if err := cl.Call(Echo, nil, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = cl.Call(Echo, nil, nil)
+	var re *ResponseError
+	if !errors.As(err, &re) || re.Code != StatusOverloaded {
+		t.Fatalf("expected StatusOverloaded; got %v", err)
+	}
+	if !re.Retryable || re.RetryAfter <= 59*time.Minute || re.RetryAfter > time.Hour {
+		t.Errorf("unexpected retry hint: %#v", re)
+	}
+
+	// methods without a limit aren't limited
+	for i := 0; i < 5; i++ {
+		if err := cl.Call(Nop, nil, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+type testIdentity struct{}
+
+func TestRateLimitKeys(t *testing.T) {
+	h := RateLimit(RateLimitOptions{
+		Limit: Limit{Rate: 1.0 / 3600},
+		Key:   KeyContext(testIdentity{}),
+	})(HandlerFunc(func(req Request, res ResponseWriter) { res.Send(nil) }))
+
+	call := func(who string) Status {
+		var req Request = &mockReq{mtd: Nop}
+		if who != "" {
+			req = RequestWithContext(req, context.WithValue(context.Background(), testIdentity{}, who))
+		}
+		res := &mockRes{}
+		h.ServeCall(req, res)
+		return res.status
+	}
+	for _, who := range []string{"alice", "bob", ""} {
+		if s := call(who); s != StatusOK {
+			t.Errorf("first call by %q: %s", who, s)
+		}
+		if s := call(who); s != StatusOverloaded {
+			t.Errorf("second call by %q: %s", who, s)
+		}
+	}
+
+	addr := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 4000}
+	if k := KeyRemoteAddr(&mockReq{remote: addr}); k != "10.0.0.1" {
+		t.Errorf("unexpected key %q", k)
+	}
+}
+
+func TestRateLimitEviction(t *testing.T) {
+	lim := Limit{Rate: 1000, Burst: 1}
+	l := RateLimit(RateLimitOptions{
+		Limit: lim,
+		Key:   KeyRemoteAddr,
+		Idle:  time.Millisecond,
+	})(NopHandler{}).(*limiter)
+
+	l.take(bucketKey{shared: true, key: "a"}, lim)
+	l.take(bucketKey{shared: true, key: "b"}, lim)
+	time.Sleep(5 * time.Millisecond)
+	l.take(bucketKey{shared: true, key: "c"}, lim)
+	l.lock.Lock()
+	n := len(l.buckets)
+	l.lock.Unlock()
+	if n != 1 {
+		t.Errorf("expected idle buckets to be evicted; have %d", n)
+	}
+}
@@ -0,0 +1,188 @@
+package synapse
+
+import (
+	"bytes"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/tinylib/msgp/msgp"
+)
+
+// Redaction describes the parts of request
+// and response bodies that are hidden in the
+// logs written by DebugRedacted and AccessLog.
+//
+// A path is a dot-separated list of map keys,
+// like "user.password". The key "*" matches
+// every key, and arrays are traversed as if
+// each element were in the place of the array,
+// so "users.password" also redacts the password
+// of every element of an array of users. The
+// empty path matches the entire body. Values
+// matched by a path are replaced with the
+// string "[REDACTED]".
+type Redaction struct {
+	// Paths are redacted
+	// in every method.
+	Paths []string
+
+	// Methods are additional paths
+	// redacted in individual methods.
+	Methods map[Method][]string
+
+	// MaxLen, if positive, is the
+	// maximum number of bytes of JSON
+	// logged for a body. Longer bodies
+	// are truncated.
+	MaxLen int
+}
+
+const redacted = "[REDACTED]"
+
+// redactor is a compiled Redaction
+type redactor struct {
+	all     [][]string
+	methods map[Method][][]string
+	max     int
+}
+
+func splitPath(p string) []string {
+	if p == "" {
+		return []string{}
+	}
+	return strings.Split(p, ".")
+}
+
+func (r *Redaction) compile() *redactor {
+	c := &redactor{max: r.MaxLen}
+	for _, p := range r.Paths {
+		c.all = append(c.all, splitPath(p))
+	}
+	if len(r.Methods) > 0 {
+		c.methods = make(map[Method][][]string, len(r.Methods))
+		for m, paths := range r.Methods {
+			for _, p := range paths {
+				c.methods[m] = append(c.methods[m], splitPath(p))
+			}
+		}
+	}
+	return c
+}
+
+// json writes the msgpack-encoded 'body' of a
+// call to 'm' to 'w' as JSON, with redaction
+// applied. it returns whether or not the
+// output was truncated.
+func (r *redactor) json(w *bytes.Buffer, m Method, body []byte) (truncated bool, err error) {
+	start := w.Len()
+	if r == nil {
+		_, err = msgp.UnmarshalAsJSON(w, body)
+		return false, err
+	}
+	paths := r.all
+	if mp := r.methods[m]; len(mp) > 0 {
+		paths = append(paths[:len(paths):len(paths)], mp...)
+	}
+	if len(paths) > 0 {
+		body, _, err = redactMsg(nil, body, paths)
+		if err != nil {
+			return false, err
+		}
+	}
+	_, err = msgp.UnmarshalAsJSON(w, body)
+	if err == nil && r.max > 0 && w.Len()-start > r.max {
+		// don't split a multi-byte character
+		cut := start + r.max
+		buf := w.Bytes()
+		for cut > start && !utf8.RuneStart(buf[cut]) {
+			cut--
+		}
+		w.Truncate(cut)
+		w.WriteString("...")
+		truncated = true
+	}
+	return truncated, err
+}
+
+// redactMsg appends the msgpack object at the
+// front of 'src' to 'dst', replacing the parts
+// matched by 'paths', and returns the remaining
+// bytes of 'src'
+func redactMsg(dst []byte, src []byte, paths [][]string) ([]byte, []byte, error) {
+	if len(paths) == 0 {
+		return copyMsg(dst, src)
+	}
+	for _, p := range paths {
+		if len(p) == 0 {
+			rest, err := msgp.Skip(src)
+			return msgp.AppendString(dst, redacted), rest, err
+		}
+	}
+	switch msgp.NextType(src) {
+	case msgp.MapType:
+		sz, rest, err := msgp.ReadMapHeaderBytes(src)
+		if err != nil {
+			return dst, rest, err
+		}
+		dst = msgp.AppendMapHeader(dst, sz)
+		for i := uint32(0); i < sz; i++ {
+			key, after, err := msgp.ReadMapKeyZC(rest)
+			if err != nil {
+				// keys that aren't strings
+				// can't match a path
+				dst, rest, err = copyMsg(dst, rest)
+				if err != nil {
+					return dst, rest, err
+				}
+				dst, rest, err = copyMsg(dst, rest)
+				if err != nil {
+					return dst, rest, err
+				}
+				continue
+			}
+			dst = append(dst, rest[:len(rest)-len(after)]...)
+			dst, rest, err = redactMsg(dst, after, subPaths(paths, string(key)))
+			if err != nil {
+				return dst, rest, err
+			}
+		}
+		return dst, rest, nil
+	case msgp.ArrayType:
+		sz, rest, err := msgp.ReadArrayHeaderBytes(src)
+		if err != nil {
+			return dst, rest, err
+		}
+		dst = msgp.AppendArrayHeader(dst, sz)
+		for i := uint32(0); i < sz; i++ {
+			dst, rest, err = redactMsg(dst, rest, paths)
+			if err != nil {
+				return dst, rest, err
+			}
+		}
+		return dst, rest, nil
+	default:
+		return copyMsg(dst, src)
+	}
+}
+
+// copyMsg appends the msgpack object
+// at the front of 'src' to 'dst'
+func copyMsg(dst []byte, src []byte) ([]byte, []byte, error) {
+	rest, err := msgp.Skip(src)
+	if err != nil {
+		return dst, rest, err
+	}
+	return append(dst, src[:len(src)-len(rest)]...), rest, nil
+}
+
+// subPaths returns the remainders
+// of the paths that match 'key'
+func subPaths(paths [][]string, key string) [][]string {
+	var out [][]string
+	for _, p := range paths {
+		if p[0] == "*" || p[0] == key {
+			out = append(out, p[1:])
+		}
+	}
+	return out
+}
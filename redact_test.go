@@ -0,0 +1,152 @@
+package synapse
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/tinylib/msgp/msgp"
+)
+
+// {"user": {"name": "bob", "password": "hunter2"},
+//  "users": [{"password": "a"}, {"password": "b", "n": 1}],
+//  "token": "secret"}
+func redactBody() []byte {
+	b := msgp.AppendMapHeader(nil, 3)
+	b = msgp.AppendString(b, "user")
+	b = msgp.AppendMapHeader(b, 2)
+	b = msgp.AppendString(b, "name")
+	b = msgp.AppendString(b, "bob")
+	b = msgp.AppendString(b, "password")
+	b = msgp.AppendString(b, "hunter2")
+	b = msgp.AppendString(b, "users")
+	b = msgp.AppendArrayHeader(b, 2)
+	b = msgp.AppendMapHeader(b, 1)
+	b = msgp.AppendString(b, "password")
+	b = msgp.AppendString(b, "a")
+	b = msgp.AppendMapHeader(b, 2)
+	b = msgp.AppendString(b, "password")
+	b = msgp.AppendString(b, "b")
+	b = msgp.AppendString(b, "n")
+	b = msgp.AppendInt(b, 1)
+	b = msgp.AppendString(b, "token")
+	b = msgp.AppendString(b, "secret")
+	return b
+}
+
+func TestRedaction(t *testing.T) {
+	r := (&Redaction{
+		Paths: []string{"user.password", "users.password"},
+		Methods: map[Method][]string{
+			Echo: {"token"},
+			Nop:  {""},
+		},
+	}).compile()
+
+	var buf bytes.Buffer
+	if _, err := r.json(&buf, Echo, redactBody()); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	for _, secret := range []string{"hunter2", `"a"`, `"b"`, "secret"} {
+		if strings.Contains(out, secret) {
+			t.Errorf("%s wasn't redacted: %s", secret, out)
+		}
+	}
+	for _, kept := range []string{"bob", `"n":1`} {
+		if !strings.Contains(out, kept) {
+			t.Errorf("%s is missing: %s", kept, out)
+		}
+	}
+	if n := strings.Count(out, redacted); n != 4 {
+		t.Errorf("expected 4 redactions; got %d: %s", n, out)
+	}
+
+	// the token is only redacted for Echo
+	buf.Reset()
+	r.json(&buf, DebugEcho, redactBody())
+	if !strings.Contains(buf.String(), "secret") || strings.Contains(buf.String(), "hunter2") {
+		t.Errorf("unexpected output for DebugEcho: %s", buf.String())
+	}
+
+	// the whole body is redacted for Nop
+	buf.Reset()
+	r.json(&buf, Nop, redactBody())
+	if buf.String() != `"`+redacted+`"` {
+		t.Errorf("expected a redacted body; got %s", buf.String())
+	}
+
+	// wildcards
+	buf.Reset()
+	(&Redaction{Paths: []string{"*.password"}}).compile().json(&buf, Echo, redactBody())
+	if strings.Contains(buf.String(), "hunter2") || strings.Contains(buf.String(), `"a"`) {
+		t.Errorf("wildcard didn't match: %s", buf.String())
+	}
+
+	// truncation
+	buf.Reset()
+	truncated, err := (&Redaction{MaxLen: 10}).compile().json(&buf, Echo, redactBody())
+	if err != nil || !truncated || buf.Len() != 13 {
+		t.Errorf("expected 10 bytes and an ellipsis; got %q (truncated=%v, err=%v)", buf.String(), truncated, err)
+	}
+
+	// truncation at a character boundary;
+	// the JSON is "\"é..." and 4 bytes
+	// end in the middle of the second é
+	buf.Reset()
+	body := msgp.AppendString(nil, strings.Repeat("é", 10))
+	_, err = (&Redaction{MaxLen: 4}).compile().json(&buf, Echo, body)
+	if err != nil || buf.String() != "\"é..." {
+		t.Errorf("expected the cut at a character boundary; got %q (err=%v)", buf.String(), err)
+	}
+	if !utf8.Valid(buf.Bytes()) {
+		t.Errorf("invalid UTF-8 in %q", buf.String())
+	}
+}
+
+func TestDebugRedacted(t *testing.T) {
+	var logs bytes.Buffer
+	h := DebugRedacted(EchoHandler{}, log.New(&logs, "", 0), Redaction{Paths: []string{"user.password"}})
+	srv, cln := net.Pipe()
+	go ServeConn(srv, h)
+	cl, err := NewClient(cln, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cl.Close()
+
+	in := msgp.Raw(redactBody())
+	if err := cl.Call(Echo, in, nil); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(logs.String(), "hunter2") {
+		t.Errorf("password was logged:\n%s", logs.String())
+	}
+	if !strings.Contains(logs.String(), "bob") {
+		t.Errorf("body wasn't logged:\n%s", logs.String())
+	}
+}
+
+func TestAccessLogRedacted(t *testing.T) {
+	a := &accessh{redact: (&Redaction{Paths: []string{"token"}, MaxLen: 8}).compile()}
+
+	attr := a.toJSON("request", Echo, redactBody())
+	if attr.Value.Kind().String() != "String" || len(attr.Value.String()) != 11 {
+		t.Errorf("expected a truncated string; got %v", attr.Value)
+	}
+
+	a.redact.max = 0
+	attr = a.toJSON("request", Echo, redactBody())
+	b, err := json.Marshal(attr.Value.Any())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(b, []byte("secret")) || !json.Valid(b) {
+		t.Errorf("unexpected output %s", b)
+	}
+}
@@ -1,8 +1,11 @@
 package synapse
 
 import (
-	"github.com/tinylib/msgp/msgp"
+	"context"
+	"crypto/tls"
 	"net"
+
+	"github.com/tinylib/msgp/msgp"
 )
 
 type Method uint32
@@ -28,16 +31,44 @@ type Request interface {
 	IsNil() bool
 }
 
+// A RawRequest is a Request that provides
+// direct access to the encoded request body.
+// The Request passed to handlers by this
+// package is a RawRequest. Proxy-style handlers
+// can use it to forward a body (as a msgp.Raw)
+// without decoding and re-encoding it.
+type RawRequest interface {
+	Request
+
+	// Body returns the msgpack-encoded
+	// body of the request. The slice is
+	// borrowed from the server: it must
+	// not be modified, and it is only valid
+	// until ServeCall returns, unless the
+	// handler calls Retain.
+	Body() []byte
+
+	// Retain transfers ownership of
+	// the body to the handler and returns
+	// it. The returned slice remains valid
+	// after ServeCall returns.
+	Retain() []byte
+}
+
 // Request implementation passed
 // to the root handler of the server.
 type request struct {
-	addr net.Addr // remote address
-	in   []byte   // body
-	mtd  uint32   // method
+	addr     net.Addr             // remote address
+	in       []byte               // body
+	md       Metadata             // request metadata; may be nil
+	mtd      uint32               // method
+	retained bool                 // Retain() was called
+	tls      *tls.ConnectionState // nil if not over TLS
 }
 
-func (r *request) Method() Method       { return Method(r.mtd) }
-func (r *request) RemoteAddr() net.Addr { return r.addr }
+func (r *request) Method() Method            { return Method(r.mtd) }
+func (r *request) RemoteAddr() net.Addr      { return r.addr }
+func (r *request) TLS() *tls.ConnectionState { return r.tls }
 
 func (r *request) Decode(m msgp.Unmarshaler) error {
 	if m != nil {
@@ -50,3 +81,69 @@ func (r *request) Decode(m msgp.Unmarshaler) error {
 func (r *request) IsNil() bool {
 	return msgp.IsNil(r.in)
 }
+
+func (r *request) Body() []byte { return r.in }
+
+func (r *request) Metadata() Metadata { return r.md }
+
+func (r *request) Retain() []byte {
+	r.retained = true
+	return r.in
+}
+
+// RequestContext returns the context
+// associated with a request, if it
+// has one, or context.Background().
+// A Request has a context if it has
+// a method
+//
+//  Context() context.Context
+//
+func RequestContext(req Request) context.Context {
+	if r, ok := req.(interface {
+		Context() context.Context
+	}); ok {
+		if ctx := r.Context(); ctx != nil {
+			return ctx
+		}
+	}
+	return context.Background()
+}
+
+// RequestWithContext returns a Request that
+// behaves like 'req', except that RequestContext
+// returns 'ctx'. Middleware can use it to pass
+// values to the handlers that they wrap. The
+// returned Request is a RawRequest, and it has
+// the same metadata as 'req'.
+func RequestWithContext(req Request, ctx context.Context) Request {
+	return &ctxRequest{Request: req, ctx: ctx}
+}
+
+type ctxRequest struct {
+	Request
+	ctx context.Context
+	raw msgp.Raw // copy of the body, if 'Request' isn't a RawRequest
+}
+
+func (c *ctxRequest) Context() context.Context  { return c.ctx }
+func (c *ctxRequest) Metadata() Metadata        { return RequestMetadata(c.Request) }
+func (c *ctxRequest) TLS() *tls.ConnectionState { return RequestTLS(c.Request) }
+
+func (c *ctxRequest) Body() []byte {
+	if r, ok := c.Request.(RawRequest); ok {
+		return r.Body()
+	}
+	if c.raw == nil {
+		c.Request.Decode(&c.raw)
+	}
+	return []byte(c.raw)
+}
+
+func (c *ctxRequest) Retain() []byte {
+	if r, ok := c.Request.(RawRequest); ok {
+		return r.Retain()
+	}
+	// the copy is already owned
+	return c.Body()
+}
@@ -0,0 +1,102 @@
+package synapse
+
+import (
+	"bytes"
+	"log"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/tinylib/msgp/msgp"
+)
+
+// forwards requests to another
+// server without decoding them
+type proxyHandler struct {
+	cl *Client
+}
+
+func (p *proxyHandler) ServeCall(req Request, res ResponseWriter) {
+	var out msgp.Raw
+	err := p.cl.Call(req.Method(), msgp.Raw(req.(RawRequest).Body()), &out)
+	if err != nil {
+		SendError(res, err)
+		return
+	}
+	res.Send(out)
+}
+
+func TestRawRequest(t *testing.T) {
+	// client -> proxy -> echo
+	bsrv, bcln := net.Pipe()
+	go ServeConn(bsrv, EchoHandler{})
+	backend, err := NewClient(bcln, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+
+	handlers := map[string]Handler{
+		"base":  &proxyHandler{cl: backend},
+		"debug": Debug(&proxyHandler{cl: backend}, log.New(os.Stderr, "proxy: ", 0)),
+	}
+	for name, h := range handlers {
+		psrv, pcln := net.Pipe()
+		go ServeConn(psrv, h)
+		cl, err := NewClient(pcln, time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		in := testData("forward me")
+		var out testData
+		if err := cl.Call(Echo, &in, &out); err != nil {
+			t.Errorf("%s: %s", name, err)
+		} else if !bytes.Equal(in, out) {
+			t.Errorf("%s: %q in; %q out", name, in, out)
+		}
+		cl.Close()
+	}
+}
+
+// retainHandler keeps every request body
+type retainHandler struct {
+	bodies chan []byte
+}
+
+func (r *retainHandler) ServeCall(req Request, res ResponseWriter) {
+	r.bodies <- req.(RawRequest).Retain()
+	res.Send(nil)
+}
+
+func TestRetain(t *testing.T) {
+	h := &retainHandler{bodies: make(chan []byte, 10)}
+	srv, cln := net.Pipe()
+	go ServeConn(srv, h, Execution(Inline, 0))
+	cl, err := NewClient(cln, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cl.Close()
+
+	// each call would re-use the same
+	// input buffer if the bodies weren't
+	// retained
+	msgs := []string{"first", "second", "third"}
+	for _, m := range msgs {
+		in := testData(m)
+		if err := cl.Call(Echo, &in, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, m := range msgs {
+		var out testData
+		if _, err := out.UnmarshalMsg(<-h.bodies); err != nil {
+			t.Fatal(err)
+		}
+		if string(out) != m {
+			t.Errorf("retained body is %q; expected %q", out, m)
+		}
+	}
+}
@@ -1,6 +1,8 @@
 package synapse
 
 import (
+	"errors"
+
 	"github.com/tinylib/msgp/msgp"
 )
 
@@ -27,6 +29,7 @@ type ResponseWriter interface {
 // ResponseWriter implementation
 type response struct {
 	out   []byte              // body
+	max   int                 // maximum body size
 	wrote bool                // written?
 	_     [sizeofPtr - 1]byte // pad
 }
@@ -41,6 +44,15 @@ func (r *response) resetLead() {
 	return
 }
 
+// limit returns the largest
+// allowed message body
+func (r *response) limit() int {
+	if r.max == 0 {
+		return maxMessageSize
+	}
+	return r.max
+}
+
 // base Error implementation
 func (r *response) Error(s Status, expl string) {
 	if r.wrote {
@@ -52,6 +64,20 @@ func (r *response) Error(s Status, expl string) {
 	r.out = msgp.AppendString(r.out, expl)
 }
 
+// base WriteError implementation
+func (r *response) WriteError(e *ResponseError) {
+	if r.wrote {
+		return
+	}
+	r.wrote = true
+	r.resetLead()
+	r.out = msgp.AppendInt(r.out, int(e.Code))
+	r.out = msgp.AppendString(r.out, e.Expl)
+	if e.hasDetails() {
+		r.out = appendErrorDetails(r.out, e)
+	}
+}
+
 // base Send implementation
 func (r *response) Send(msg msgp.Marshaler) error {
 	if r.wrote {
@@ -67,7 +93,7 @@ func (r *response) Send(msg msgp.Marshaler) error {
 		if err != nil {
 			return err
 		}
-		if len(r.out) > maxMessageSize {
+		if len(r.out) > r.limit() {
 			return ErrTooLarge
 		}
 		return nil
@@ -75,3 +101,21 @@ func (r *response) Send(msg msgp.Marshaler) error {
 	r.out = msgp.AppendNil(r.out)
 	return nil
 }
+
+// SendError writes 'err' to 'res'. If 'err'
+// is (or wraps) a *ResponseError, it is sent
+// to the client, including its optional fields
+// if 'res' is an ErrorWriter; otherwise, the
+// error is sent with StatusServerError.
+func SendError(res ResponseWriter, err error) {
+	var re *ResponseError
+	if !errors.As(err, &re) {
+		res.Error(StatusServerError, err.Error())
+		return
+	}
+	if ew, ok := res.(ErrorWriter); ok && re.hasDetails() {
+		ew.WriteError(re)
+		return
+	}
+	res.Error(re.Code, re.Expl)
+}
@@ -0,0 +1,18 @@
+// Package sema provides a minimal
+// counting semaphore.
+//
+// By default, Wait and Wake are implemented
+// in portable Go. Building with the 'synapse_asm'
+// tag on 386, amd64, and arm links them directly
+// against the runtime's semaphore implementation
+// instead, which is slightly faster but depends
+// upon runtime internals.
+package sema
+
+// Point is a semaphore. The zero
+// value has a count of zero. Wait
+// blocks until the count is positive
+// and then decrements it, and Wake
+// increments the count, releasing
+// at most one waiter.
+type Point uint32
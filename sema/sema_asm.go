@@ -1,9 +1,8 @@
-// +build go1.4
+// +build go1.4,synapse_asm
+// +build 386 amd64 arm
 
 package sema
 
-type Point uint32
-
 //go:noescape
 func Wait(p *Point)
 
@@ -0,0 +1,142 @@
+// +build !synapse_asm !386,!amd64,!arm
+
+package sema
+
+import (
+	"sync"
+	"sync/atomic"
+	"unsafe"
+)
+
+// this is a scaled-down version of
+// the runtime's semaphore table: waiters
+// are queued in one of a fixed number
+// of buckets, selected by the address
+// of the Point they are waiting on.
+
+const nbuckets = 251
+
+type waiter struct {
+	p    *Point
+	next *waiter
+	c    chan struct{}
+}
+
+type bucket struct {
+	sync.Mutex
+	nwait uint32  // number of queued waiters; atomic
+	head  *waiter // FIFO queue of waiters
+	tail  *waiter
+	_     [40]byte // avoid false sharing
+}
+
+var (
+	table   [nbuckets]bucket
+	waiters = sync.Pool{
+		New: func() interface{} {
+			return &waiter{c: make(chan struct{}, 1)}
+		},
+	}
+)
+
+func bucketFor(p *Point) *bucket {
+	return &table[(uintptr(unsafe.Pointer(p))>>3)%nbuckets]
+}
+
+// acquire decrements the count
+// if it is positive
+func acquire(p *Point) bool {
+	for {
+		v := atomic.LoadUint32((*uint32)(p))
+		if v == 0 {
+			return false
+		}
+		if atomic.CompareAndSwapUint32((*uint32)(p), v, v-1) {
+			return true
+		}
+	}
+}
+
+func (b *bucket) enqueue(w *waiter) {
+	if b.tail == nil {
+		b.head = w
+	} else {
+		b.tail.next = w
+	}
+	b.tail = w
+}
+
+// dequeue removes the first
+// waiter on 'p', if any
+func (b *bucket) dequeue(p *Point) *waiter {
+	var prev *waiter
+	for w := b.head; w != nil; prev, w = w, w.next {
+		if w.p != p {
+			continue
+		}
+		if prev == nil {
+			b.head = w.next
+		} else {
+			prev.next = w.next
+		}
+		if b.tail == w {
+			b.tail = prev
+		}
+		w.next = nil
+		return w
+	}
+	return nil
+}
+
+// Wait blocks until the count
+// of 'p' is positive, and then
+// decrements it.
+func Wait(p *Point) {
+	if acquire(p) {
+		return
+	}
+	b := bucketFor(p)
+	w := waiters.Get().(*waiter)
+	w.p = p
+	for {
+		b.Lock()
+		// registering as a waiter before
+		// re-checking the count ensures
+		// that a concurrent Wake either
+		// sees the waiter or leaves a
+		// count that we can acquire here
+		atomic.AddUint32(&b.nwait, 1)
+		if acquire(p) {
+			atomic.AddUint32(&b.nwait, ^uint32(0))
+			b.Unlock()
+			break
+		}
+		b.enqueue(w)
+		b.Unlock()
+		<-w.c
+		if acquire(p) {
+			break
+		}
+	}
+	w.p = nil
+	waiters.Put(w)
+}
+
+// Wake increments the count of 'p'
+// and releases one waiter, if any.
+func Wake(p *Point) {
+	atomic.AddUint32((*uint32)(p), 1)
+	b := bucketFor(p)
+	if atomic.LoadUint32(&b.nwait) == 0 {
+		return
+	}
+	b.Lock()
+	w := b.dequeue(p)
+	if w != nil {
+		atomic.AddUint32(&b.nwait, ^uint32(0))
+	}
+	b.Unlock()
+	if w != nil {
+		w.c <- struct{}{}
+	}
+}
@@ -0,0 +1,93 @@
+package sema
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWakeThenWait(t *testing.T) {
+	var p Point
+	Wake(&p)
+	Wake(&p)
+	Wait(&p)
+	Wait(&p)
+	if p != 0 {
+		t.Errorf("expected count 0; got %d", p)
+	}
+}
+
+func TestWaitBlocks(t *testing.T) {
+	var p Point
+	done := make(chan struct{})
+	go func() {
+		Wait(&p)
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Fatal("Wait returned before Wake")
+	case <-time.After(20 * time.Millisecond):
+	}
+	Wake(&p)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Wait didn't return after Wake")
+	}
+}
+
+func TestPingPong(t *testing.T) {
+	var a, b Point
+	const rounds = 10000
+	go func() {
+		for i := 0; i < rounds; i++ {
+			Wait(&a)
+			Wake(&b)
+		}
+	}()
+	for i := 0; i < rounds; i++ {
+		Wake(&a)
+		Wait(&b)
+	}
+}
+
+func TestManyWaiters(t *testing.T) {
+	const (
+		points  = 64
+		waiters = 8
+	)
+	var (
+		ps [points]Point
+		wg sync.WaitGroup
+	)
+	for i := range ps {
+		for j := 0; j < waiters; j++ {
+			wg.Add(1)
+			go func(p *Point) {
+				Wait(p)
+				wg.Done()
+			}(&ps[i])
+		}
+	}
+	for i := range ps {
+		for j := 0; j < waiters; j++ {
+			go Wake(&ps[i])
+		}
+	}
+	wg.Wait()
+}
+
+func BenchmarkPingPong(b *testing.B) {
+	var x, y Point
+	go func() {
+		for i := 0; i < b.N; i++ {
+			Wait(&x)
+			Wake(&y)
+		}
+	}()
+	for i := 0; i < b.N; i++ {
+		Wake(&x)
+		Wait(&y)
+	}
+}
@@ -5,6 +5,8 @@ import (
 	"math"
 	"net"
 	"sync"
+	"sync/atomic"
+	"time"
 	"unsafe"
 
 	"github.com/philhofer/fwd"
@@ -28,38 +30,70 @@ const (
 // In principle, the client can operate on any net.Conn, and the
 // Server can operate on any net.Listener.
 
-// Serve starts a Server on 'l' that serves
-// the supplied handler. It blocks until the
-// listener closes.
-func Serve(l net.Listener, h Handler) error {
+// Server serves a Handler on any number
+// of listeners and connections, which share
+// its options and its pool of request state.
+type Server struct {
+	h        Handler
+	cfg      config
+	wrappers connStack  // pool of *connWrapper
+	workers  workerPool // used in WorkerPool mode
+	start    time.Time  // creation time
+	clock    sync.Mutex // protects conns
+	conns    map[*connHandler]struct{}
+}
+
+// NewServer creates a Server that
+// serves 'h' with the provided options.
+func NewServer(h Handler, opts ...Option) *Server {
+	s := &Server{h: h, start: time.Now()}
+	s.cfg.apply(opts)
+	s.wrappers.init(s.cfg.pool())
+	return s
+}
+
+// Serve accepts connections on 'l' and
+// serves each one in its own goroutine.
+// It blocks until the listener closes.
+func (s *Server) Serve(l net.Listener) error {
 	for {
 		c, err := l.Accept()
 		if err != nil {
 			return err
 		}
-		go ServeConn(c, h)
+		go s.ServeConn(c)
 	}
 }
 
+// Serve starts a Server on 'l' that serves
+// the supplied handler. It blocks until the
+// listener closes.
+func Serve(l net.Listener, h Handler, opts ...Option) error {
+	return NewServer(h, opts...).Serve(l)
+}
+
 // ListenAndServeTLS acts identically to ListenAndServe, except that
 // it expects connections over TLS1.2 (see crypto/tls). Additionally,
 // files containing a certificate and matching private key for the
 // Server must be provided. If the certificate is signed by a
 // certificate authority, the certFile should be the concatenation of
-// the server's certificate followed by the CA's certificate.
-func ListenAndServeTLS(network, laddr string, certFile, keyFile string, h Handler) error {
-	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+// the server's certificate followed by the CA's certificate. The
+// certificate is reloaded when the files change (see CertReloader).
+// To verify client certificates, use ListenAndServeMutualTLS.
+func ListenAndServeTLS(network, laddr string, certFile, keyFile string, h Handler, opts ...Option) error {
+	r, err := NewCertReloader(certFile, keyFile)
 	if err != nil {
 		return err
 	}
 
 	l, err := tls.Listen(network, laddr, &tls.Config{
-		Certificates: []tls.Certificate{cert},
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: r.GetCertificate,
 	})
 	if err != nil {
 		return err
 	}
-	return Serve(l, h)
+	return Serve(l, h, opts...)
 }
 
 // ListenAndServe opens up a network listener
@@ -67,28 +101,80 @@ func ListenAndServeTLS(network, laddr string, certFile, keyFile string, h Handle
 // and begins serving with the provided handler.
 // ListenAndServe blocks until there is a fatal
 // listener error.
-func ListenAndServe(network string, laddr string, h Handler) error {
+func ListenAndServe(network string, laddr string, h Handler, opts ...Option) error {
 	l, err := net.Listen(network, laddr)
 	if err != nil {
 		return err
 	}
-	return Serve(l, h)
+	return Serve(l, h, opts...)
+}
+
+// ServeConn serves an individual network
+// connection. It blocks until the connection
+// is closed or it encounters a fatal error.
+func ServeConn(c net.Conn, h Handler, opts ...Option) {
+	NewServer(h, opts...).ServeConn(c)
 }
 
+// tlsHandshakeTimeout is the longest that
+// a server waits for a TLS handshake
+var tlsHandshakeTimeout = 10 * time.Second
+
 // ServeConn serves an individual network
 // connection. It blocks until the connection
 // is closed or it encounters a fatal error.
-func ServeConn(c net.Conn, h Handler) {
+func (s *Server) ServeConn(c net.Conn) {
+	// finish the TLS handshake up front
+	// so that handlers can see the peer's
+	// certificates. the deadline keeps peers
+	// that never finish the handshake from
+	// holding on to the connection.
+	var cs *tls.ConnectionState
+	if tc, ok := c.(*tls.Conn); ok {
+		c.SetDeadline(time.Now().Add(tlsHandshakeTimeout))
+		err := tc.Handshake()
+		if err == nil {
+			err = c.SetDeadline(time.Time{})
+		}
+		if err != nil {
+			c.Close()
+			return
+		}
+		state := tc.ConnectionState()
+		cs = &state
+	}
 	ch := connHandler{
+		tls:     cs,
 		conn:    c,
-		h:       h,
+		h:       s.h,
+		srv:     s,
+		cfg:     &s.cfg,
 		remote:  c.RemoteAddr(),
 		writing: make(chan *connWrapper, 32),
 	}
-	go ch.writeLoop()
+	ch.since = time.Now()
+	ch.last = ch.since.UnixNano()
+	s.cfg.metrics.connOpened(sideServer)
+	s.addConn(&ch)
+	if s.cfg.exec == WorkerPool || s.cfg.exec == Inline {
+		ch.jobs = s.workers.acquire(s.cfg.workers)
+		ch.slots = make(chan struct{}, maxQueued)
+	}
+	if s.cfg.vector > 0 {
+		go ch.writeLoopv()
+	} else {
+		go ch.writeLoop()
+	}
+	stop := ch.startKeepalive()
 	ch.connLoop()     // returns on connection close
+	stop()            // stop pinging
 	ch.wg.Wait()      // wait for handlers to return
 	close(ch.writing) // close output queue
+	if ch.jobs != nil {
+		s.workers.release()
+	}
+	s.removeConn(&ch)
+	s.cfg.metrics.connClosed(sideServer)
 }
 
 func readFrame(lead [leadSize]byte) (seq uint64, ft fType, sz int) {
@@ -120,11 +206,25 @@ func putFrame(bts []byte, seq uint64, ft fType, sz int) {
 // connections and multiplexes requests
 // to connWrappers
 type connHandler struct {
-	h       Handler
-	conn    net.Conn
-	remote  net.Addr
-	wg      sync.WaitGroup    // outstanding handlers
-	writing chan *connWrapper // write queue
+	h        Handler
+	srv      *Server
+	cfg      *config
+	conn     net.Conn
+	remote   net.Addr
+	wg       sync.WaitGroup          // outstanding handlers
+	writing  chan *connWrapper       // write queue
+	jobs     chan<- job              // worker queue, in WorkerPool and Inline modes
+	slots    chan struct{}           // requests in progress, when jobs is set
+	features uint32                  // negotiated Features; atomic
+	plock    sync.Mutex              // protects peer
+	peer     PeerInfo                // client's handshake, if any
+	last     int64                   // time of last read, in unix nanoseconds; atomic
+	pinged   int64                   // time of last keepalive ping; atomic
+	rtt      int64                   // last keepalive round-trip time; atomic
+	since    time.Time               // time the connection was opened
+	tls      *tls.ConnectionState    // nil if not over TLS
+	alock    sync.Mutex              // protects active
+	active   map[*connWrapper]active // requests in progress, with Introspection
 }
 
 func (c *connHandler) writeLoop() error {
@@ -157,13 +257,13 @@ func (c *connHandler) writeLoop() error {
 			goto flush
 		}
 
-		wrappers.push(cw)
+		c.srv.wrappers.push(cw)
 	more:
 		select {
 		case another, ok := <-c.writing:
 			if ok {
 				f := c.do(bwr.Write(another.res.out))
-				wrappers.push(another)
+				c.srv.wrappers.push(another)
 				if !f {
 					goto flush
 				}
@@ -180,7 +280,7 @@ func (c *connHandler) writeLoop() error {
 	}
 flush:
 	for w := range c.writing {
-		wrappers.push(w)
+		c.srv.wrappers.push(w)
 	}
 	return err
 }
@@ -194,8 +294,8 @@ func (c *connHandler) do(i int, err error) bool {
 }
 
 // connLoop continuously polls the connection.
-// requests are read synchronously; the responses
-// are written in a spawned goroutine
+// requests are read synchronously; handlers are
+// run according to the server's ExecMode
 func (c *connHandler) connLoop() {
 	brd := fwd.NewReaderSize(c.conn, 4096)
 
@@ -205,6 +305,7 @@ func (c *connHandler) connLoop() {
 		sz    int
 		frame fType
 		err   error
+		zbuf  []byte // compressed bodies
 	)
 
 	for {
@@ -216,6 +317,19 @@ func (c *connHandler) connLoop() {
 			return
 		}
 		seq, frame, sz = readFrame(lead)
+		compressed := frame&fCompressed != 0
+		meta := frame&fMetadata != 0
+		frame &^= fCompressed | fMetadata
+		atomic.StoreInt64(&c.last, time.Now().UnixNano())
+		c.cfg.metrics.read(sideServer, leadSize+sz)
+
+		if frame == fPONG {
+			c.gotPong()
+			if !c.do(brd.Skip(sz)) {
+				return
+			}
+			continue
+		}
 
 		// handle commands
 		if frame == fCMD {
@@ -252,22 +366,51 @@ func (c *connHandler) connLoop() {
 			continue
 		}
 
-		w := wrappers.pop()
+		w := c.srv.wrappers.pop()
 
-		if cap(w.in) >= sz {
-			w.in = w.in[0:sz]
+		if compressed {
+			if cap(zbuf) >= sz {
+				zbuf = zbuf[:sz]
+			} else {
+				zbuf = make([]byte, sz)
+			}
+			if !c.do(brd.ReadFull(zbuf)) {
+				return
+			}
+			// a body that can't be decompressed
+			// is reported as a malformed request
+			w.in, err = inflate(w.in, zbuf)
+			if err != nil {
+				w.in = w.in[:0]
+			}
 		} else {
-			w.in = make([]byte, sz)
-		}
+			if cap(w.in) >= sz {
+				w.in = w.in[0:sz]
+			} else {
+				w.in = make([]byte, sz)
+			}
 
-		if !c.do(brd.ReadFull(w.in)) {
-			return
+			if !c.do(brd.ReadFull(w.in)) {
+				return
+			}
 		}
 
 		// trigger handler
 		w.seq = seq
+		w.meta = meta
 		c.wg.Add(1)
-		go c.handleReq(w)
+		c.cfg.metrics.start(sideServer)
+		if c.slots != nil {
+			c.slots <- struct{}{}
+		}
+		switch {
+		case c.cfg.exec == Inline && len(w.in) <= c.cfg.inlineLimit():
+			c.handleReq(w)
+		case c.jobs != nil:
+			c.jobs <- job{c: c, w: w}
+		default:
+			go c.handleReq(w)
+		}
 	}
 }
 
@@ -277,44 +420,96 @@ type connWrapper struct {
 	next *connWrapper // only used by slab
 	seq  uint64       // sequence number
 	req  request      // (8w)
-	res  response     // (4w)
+	res  response     // (5w)
 	in   []byte       // incoming message
+	z    []byte       // compression scratch space
+	meta bool         // 'in' begins with metadata
 }
 
 // handleconn sets up the Request and ResponseWriter
 // interfaces and calls the handler.
 func (c *connHandler) handleReq(cw *connWrapper) {
 	// clear/reset everything
+	cw.req.mtd = 0
 	cw.req.addr = c.remote
+	cw.req.tls = c.tls
 	cw.res.wrote = false
+	zip := c.negotiated().Has(FeatureCompression)
+	if zip {
+		cw.res.max = maxInflatedSize
+	} else {
+		cw.res.max = maxMessageSize
+	}
 
 	var err error
+	var start time.Time
+	if c.cfg.metrics != nil {
+		start = time.Now()
+	}
 
-	// split request into 'name' and body
-	cw.req.mtd, cw.req.in, err = msgp.ReadUint32Bytes(cw.in)
+	// split request into metadata,
+	// 'name' and body
+	in := cw.in
+	if cw.meta {
+		cw.req.md, in, err = readMetadata(in)
+	}
+	if err == nil {
+		cw.req.mtd, cw.req.in, err = msgp.ReadUint32Bytes(in)
+	}
 	if err != nil {
 		cw.res.Error(StatusBadRequest, "malformed request method")
 	} else {
+		if c.cfg.introspect {
+			c.track(cw)
+		}
 		c.h.ServeCall(&cw.req, &cw.res)
+		if c.cfg.introspect {
+			c.untrack(cw)
+		}
 		// if the handler didn't write a body,
 		// write 'nil'
 		if !cw.res.wrote {
 			cw.res.Send(nil)
 		}
+		// the handler owns the input
+		// buffer if it retained the body
+		if cw.req.retained {
+			cw.in = nil
+			cw.req.retained = false
+		}
+	}
+	cw.req.in = nil
+	cw.req.md = nil
+	if m := c.cfg.metrics; m != nil {
+		m.finish(sideServer, Method(cw.req.mtd), responseStatus(cw.res.out), time.Since(start))
 	}
 
+	ft := fRES
+	if zip {
+		var flag fType
+		cw.res.out, cw.z, flag = compressFrame(cw.res.out, cw.z, c.cfg.threshold)
+		ft |= flag
+	}
 	blen := len(cw.res.out) - leadSize // length minus frame length
-	putFrame(cw.res.out, cw.seq, fRES, blen)
-	c.writing <- cw
-	c.wg.Done()
+	if blen > maxMessageSize {
+		// compression wasn't enough
+		cw.res.wrote = false
+		cw.res.Error(StatusServerError, "response too large")
+		ft, blen = fRES, len(cw.res.out)-leadSize
+	}
+	putFrame(cw.res.out, cw.seq, ft, blen)
+	c.cfg.metrics.wrote(sideServer, len(cw.res.out))
+	c.queue(cw)
 }
 
 func handleCmd(c *connHandler, seq uint64, cmd command, body []byte) {
-	if cmd == cmdInvalid || cmd >= _maxcommand {
-		return
+	// unknown commands are answered
+	// with cmdInvalid so that newer
+	// clients can detect older servers
+	var act action
+	if cmd != cmdInvalid && cmd < _maxcommand {
+		act = cmdDirectory[cmd]
 	}
-
-	act := cmdDirectory[cmd]
 	resbyte := byte(cmd)
 	var res []byte
 	var err error
@@ -329,7 +524,7 @@ func handleCmd(c *connHandler, seq uint64, cmd command, body []byte) {
 
 	// for now, we'll use one of the
 	// connection wrappers
-	wr := wrappers.pop()
+	wr := c.srv.wrappers.pop()
 
 	sz := len(res) + 1
 	need := sz + leadSize
@@ -344,6 +539,7 @@ func handleCmd(c *connHandler, seq uint64, cmd command, body []byte) {
 	if res != nil {
 		copy(wr.res.out[leadSize+1:], res)
 	}
+	c.cfg.metrics.wrote(sideServer, len(wr.res.out))
 	c.writing <- wr
 	c.wg.Done()
 }
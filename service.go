@@ -0,0 +1,271 @@
+package synapse
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+
+	"github.com/tinylib/msgp/msgp"
+)
+
+var (
+	typeOfContext      = reflect.TypeOf((*context.Context)(nil)).Elem()
+	typeOfError        = reflect.TypeOf((*error)(nil)).Elem()
+	typeOfMarshaler    = reflect.TypeOf((*msgp.Marshaler)(nil)).Elem()
+	typeOfUnmarshaler  = reflect.TypeOf((*msgp.Unmarshaler)(nil)).Elem()
+	errNoServiceMethod = errors.New("synapse: type has no suitable service methods")
+	errNilService      = errors.New("synapse: nil service")
+)
+
+// Service is a Handler built from the
+// methods of an object. See RegisterService.
+type Service struct {
+	name    string
+	rcvr    reflect.Value
+	methods []svcMethod
+	byName  map[string]Method
+}
+
+// svcMethod is one service method
+type svcMethod struct {
+	name string
+	fn   reflect.Value // unbound method; nil on the client side
+	in   reflect.Type  // request type (pointer)
+	out  reflect.Type  // response type (pointer)
+}
+
+// RegisterService builds a Handler out of the
+// exported methods of 'obj' that have the form
+//
+//  func (t *T) Name(ctx context.Context, in *Req) (*Res, error)
+//
+// where *Req and *Res implement both msgp.Marshaler
+// and msgp.Unmarshaler. Methods of any other form
+// are ignored.
+//
+// Methods are numbered in lexical order of their
+// names, starting at zero, so the Method of each
+// call is the same for every object with the same
+// method set. Use NewServiceClient with the same
+// type (or an interface type with the same methods)
+// on the client side to make calls.
+//
+// If a method returns a *ResponseError, its code
+// and explanation are sent to the client; any other
+// error is sent as StatusServerError. RegisterService
+// returns an error if 'obj' is nil.
+func RegisterService(obj interface{}) (*Service, error) {
+	rcvr := reflect.ValueOf(obj)
+	if !rcvr.IsValid() {
+		return nil, errNilService
+	}
+	switch rcvr.Kind() {
+	case reflect.Ptr, reflect.Interface, reflect.Map, reflect.Func, reflect.Chan, reflect.Slice:
+		if rcvr.IsNil() {
+			return nil, fmt.Errorf("%w: %s", errNilService, rcvr.Type())
+		}
+	}
+	s, err := newService(rcvr.Type(), 1)
+	if err != nil {
+		return nil, err
+	}
+	s.rcvr = rcvr
+	for i := range s.methods {
+		m, _ := rcvr.Type().MethodByName(s.methods[i].name)
+		s.methods[i].fn = m.Func
+	}
+	return s, nil
+}
+
+// newService inspects the method set of 't'.
+// 'off' is the number of leading arguments
+// (i.e. the receiver) that precede the context.
+func newService(t reflect.Type, off int) (*Service, error) {
+	s := &Service{
+		name:   t.String(),
+		byName: make(map[string]Method),
+	}
+	// (reflect.Type).Method returns methods
+	// in lexical order, which makes method
+	// numbering deterministic
+	for i := 0; i < t.NumMethod(); i++ {
+		m := t.Method(i)
+		if m.PkgPath != "" {
+			continue
+		}
+		mt := m.Type
+		if mt.NumIn() != off+2 || mt.NumOut() != 2 {
+			continue
+		}
+		if mt.In(off) != typeOfContext || mt.Out(1) != typeOfError {
+			continue
+		}
+		in, out := mt.In(off+1), mt.Out(0)
+		if !isMsgPtr(in) || !isMsgPtr(out) {
+			continue
+		}
+		s.byName[m.Name] = Method(len(s.methods))
+		s.methods = append(s.methods, svcMethod{name: m.Name, in: in, out: out})
+	}
+	if len(s.methods) == 0 {
+		return nil, fmt.Errorf("%w: %s", errNoServiceMethod, t)
+	}
+	return s, nil
+}
+
+// isMsgPtr returns whether or not 't' is
+// a pointer type that can be both encoded
+// and decoded, since each side of the
+// connection has to do both.
+func isMsgPtr(t reflect.Type) bool {
+	return t.Kind() == reflect.Ptr && t.Implements(typeOfMarshaler) && t.Implements(typeOfUnmarshaler)
+}
+
+// Name returns the name of the
+// service's underlying type.
+func (s *Service) Name() string { return s.name }
+
+// Method returns the Method assigned
+// to the service method with the given name.
+func (s *Service) Method(name string) (Method, bool) {
+	m, ok := s.byName[name]
+	return m, ok
+}
+
+// MethodName returns the name of the
+// service method assigned to 'm', or
+// the empty string if it doesn't exist.
+func (s *Service) MethodName(m Method) string {
+	if int(m) >= len(s.methods) {
+		return ""
+	}
+	return s.methods[m].name
+}
+
+// ServeCall implements Handler
+func (s *Service) ServeCall(req Request, res ResponseWriter) {
+	m := req.Method()
+	if int(m) >= len(s.methods) {
+		res.Error(StatusNotFound, "no such method")
+		return
+	}
+	sm := &s.methods[m]
+	in := reflect.New(sm.in.Elem())
+	err := req.Decode(in.Interface().(msgp.Unmarshaler))
+	if err != nil {
+		res.Error(StatusBadRequest, err.Error())
+		return
+	}
+	ret := sm.fn.Call([]reflect.Value{s.rcvr, reflect.ValueOf(RequestContext(req)), in})
+	if e := ret[1].Interface(); e != nil {
+		SendError(res, e.(error))
+		return
+	}
+	if ret[0].IsNil() {
+		res.Send(nil)
+		return
+	}
+	res.Send(ret[0].Interface().(msgp.Marshaler))
+}
+
+// ServiceClient is the client-side
+// counterpart of a Service. It checks
+// the types of arguments against the
+// service's method signatures before
+// making calls.
+type ServiceClient struct {
+	c *Client
+	s *Service
+}
+
+// NewServiceClient returns a ServiceClient that
+// calls the methods of 'typ' on the server behind 'c'.
+// 'typ' can be a value of the same type that was
+// passed to RegisterService on the server side, or
+// a pointer to an interface type with the same
+// method set, e.g.
+//
+//  sc, err := synapse.NewServiceClient(cl, (*Arith)(nil))
+//
+func NewServiceClient(c *Client, typ interface{}) (*ServiceClient, error) {
+	if c == nil {
+		return nil, errors.New("synapse: nil client")
+	}
+	t := reflect.TypeOf(typ)
+	if t == nil {
+		return nil, errNilService
+	}
+	off := 1
+	if t.Kind() == reflect.Ptr && t.Elem().Kind() == reflect.Interface {
+		t = t.Elem()
+		off = 0
+	}
+	s, err := newService(t, off)
+	if err != nil {
+		return nil, err
+	}
+	return &ServiceClient{c: c, s: s}, nil
+}
+
+// Service returns the method table
+// used by the client.
+func (sc *ServiceClient) Service() *Service { return sc.s }
+
+// Caller returns a ServiceCaller for
+// the named service method.
+func (sc *ServiceClient) Caller(name string) (*ServiceCaller, error) {
+	m, ok := sc.s.byName[name]
+	if !ok {
+		return nil, fmt.Errorf("synapse: service %s has no method %q", sc.s.name, name)
+	}
+	sm := &sc.s.methods[m]
+	return &ServiceCaller{
+		c:    sc.c,
+		name: sc.s.name + "." + name,
+		m:    m,
+		in:   sm.in,
+		out:  sm.out,
+	}, nil
+}
+
+// Call calls the named service method. It is
+// shorthand for Caller followed by Call; to call
+// a method repeatedly, keep the ServiceCaller.
+func (sc *ServiceClient) Call(ctx context.Context, name string, in msgp.Marshaler, out msgp.Unmarshaler) error {
+	c, err := sc.Caller(name)
+	if err != nil {
+		return err
+	}
+	return c.Call(ctx, in, out)
+}
+
+// ServiceCaller calls one method of a
+// service. It is safe for concurrent use.
+type ServiceCaller struct {
+	c    *Client
+	name string // Service.Method, for errors
+	m    Method
+	in   reflect.Type
+	out  reflect.Type
+}
+
+// Method returns the Method that
+// the caller calls.
+func (sc *ServiceCaller) Method() Method { return sc.m }
+
+// Call calls the method with 'in' as the argument
+// and decodes the response into 'out'. The types of
+// 'in' and 'out' must match the method's signature.
+// The call is made with (*Client).CallContext, so
+// the client's interceptors and the deadline and
+// cancellation of 'ctx' apply to it.
+func (sc *ServiceCaller) Call(ctx context.Context, in msgp.Marshaler, out msgp.Unmarshaler) error {
+	if in != nil && reflect.TypeOf(in) != sc.in {
+		return fmt.Errorf("synapse: %s takes %s, not %T", sc.name, sc.in, in)
+	}
+	if out != nil && reflect.TypeOf(out) != sc.out {
+		return fmt.Errorf("synapse: %s returns %s, not %T", sc.name, sc.out, out)
+	}
+	return sc.c.CallContext(ctx, sc.m, in, out)
+}
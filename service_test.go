@@ -0,0 +1,109 @@
+package synapse
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+type strService struct{}
+
+func (s *strService) Upper(ctx context.Context, in *String) (*String, error) {
+	out := String(strings.ToUpper(string(*in)))
+	return &out, nil
+}
+
+func (s *strService) Fail(ctx context.Context, in *String) (*String, error) {
+	return nil, &ResponseError{Code: StatusCondition, Expl: string(*in)}
+}
+
+// not a service method
+func (s *strService) Other(x int) int { return x }
+
+type strCaller interface {
+	Fail(context.Context, *String) (*String, error)
+	Upper(context.Context, *String) (*String, error)
+}
+
+func TestService(t *testing.T) {
+	svc, err := RegisterService(&strService{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m, ok := svc.Method("Upper"); !ok || m != 1 {
+		t.Fatalf("expected Upper to be method 1; got %d (%t)", m, ok)
+	}
+	if _, ok := svc.Method("Other"); ok {
+		t.Fatal("Other should not be a service method")
+	}
+
+	srv, cln := net.Pipe()
+	go ServeConn(srv, svc)
+	cl, err := NewClient(cln, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cl.Close()
+
+	sc, err := NewServiceClient(cl, (*strCaller)(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	in := String("hello")
+	var out String
+	err = sc.Call(ctx, "Upper", &in, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out != "HELLO" {
+		t.Errorf("expected %q; got %q", "HELLO", out)
+	}
+
+	err = sc.Call(ctx, "Fail", &in, &out)
+	if !isCode(err, StatusCondition) {
+		t.Errorf("expected precondition failure; got %v", err)
+	}
+
+	upper, err := sc.Caller("Upper")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if upper.Method() != 1 {
+		t.Errorf("expected Upper to be method 1; got %d", upper.Method())
+	}
+	var bad testData
+	err = upper.Call(ctx, &in, &bad)
+	if err == nil {
+		t.Error("expected an error calling Upper with the wrong response type")
+	}
+	if _, err := sc.Caller("Other"); err == nil {
+		t.Error("expected an error for a method that doesn't exist")
+	}
+
+	// the context applies to the call
+	cctx, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := upper.Call(cctx, &in, &out); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled; got %v", err)
+	}
+}
+
+func TestServiceErrors(t *testing.T) {
+	if _, err := RegisterService(nil); !errors.Is(err, errNilService) {
+		t.Errorf("expected errNilService; got %v", err)
+	}
+	if _, err := RegisterService((*strService)(nil)); !errors.Is(err, errNilService) {
+		t.Errorf("expected errNilService for a nil pointer; got %v", err)
+	}
+	if _, err := RegisterService(struct{}{}); !errors.Is(err, errNoServiceMethod) {
+		t.Errorf("expected errNoServiceMethod; got %v", err)
+	}
+	if _, err := NewServiceClient(nil, (*strCaller)(nil)); err == nil {
+		t.Error("expected an error for a nil client")
+	}
+}
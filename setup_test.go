@@ -74,10 +74,25 @@ func finish(c io.Closer) {
 	time.Sleep(1 * time.Millisecond)
 }
 
+type FailHandler struct{}
+
+// FailHandler responds with a detailed error
+func (f FailHandler) ServeCall(req Request, res ResponseWriter) {
+	SendError(res, &ResponseError{
+		Code:       StatusServerError,
+		Expl:       "try again later",
+		AppCode:    42,
+		Retryable:  true,
+		RetryAfter: time.Second,
+		Details:    msgp.Raw(msgp.AppendString(nil, "some details")),
+	})
+}
+
 const (
 	Echo Method = iota
 	Nop
 	DebugEcho
+	Fail
 )
 
 func TestMain(m *testing.M) {
@@ -85,11 +100,13 @@ func TestMain(m *testing.M) {
 	RegisterName(Echo, "echo")
 	RegisterName(Nop, "nop")
 	RegisterName(DebugEcho, "debug-echo")
+	RegisterName(Fail, "fail")
 
 	rt = &RouteTable{
 		Echo:      EchoHandler{},
 		Nop:       NopHandler{},
 		DebugEcho: Debug(EchoHandler{}, log.New(os.Stderr, "debug-echo :: ", log.LstdFlags)),
+		Fail:      FailHandler{},
 	}
 
 	l, err := net.Listen("tcp", ":7070")
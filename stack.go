@@ -6,103 +6,121 @@ import (
 	"github.com/tinylib/spin"
 )
 
-// this file is just defines a thread-safe
-// stack to use as a free-list for *connWrapper
-// and *waiter structures, since they are allocated
-// and de-allocated frequently and predictably.
+// this file defines thread-safe stacks
+// to use as free-lists for *connWrapper
+// and *waiter structures, since they are
+// allocated and de-allocated frequently
+// and predictably.
 //
-// we statically allocate 'arenaSize' waiters
-// and connWrappers in contiguous blocks, and
-// then create a LIFO out of them during
-// initialization. if we run out of elements
-// in the stack, we fall back to using the
-// heap. wrappers are heap-allocated if
-// c.next == c, and waiters are heap allocated
-// if (*waiter).static == false.
-
-const arenaSize = 512
-
-var (
-	waiters  waitStack
-	wrappers connStack
-
-	waiterSlab  [arenaSize]waiter
-	wrapperSlab [arenaSize]connWrapper
-)
-
-func init() {
-	// set up the pointers and lock
-	// the waiter semaphores
-	waiterSlab[0].static = true
-	for i := 0; i < (arenaSize - 1); i++ {
-		waiterSlab[i].next = &waiterSlab[i+1]
-		waiterSlab[i+1].static = true
-		wrapperSlab[i].next = &wrapperSlab[i+1]
-	}
-	waiters.top = &waiterSlab[0]
-	wrappers.top = &wrapperSlab[0]
-}
+// each Client has its own stack of waiters,
+// and each Server has its own stack of
+// connWrappers. the stacks start out empty
+// and are filled as objects are returned
+// to them, up to a configurable capacity
+// (see PoolSize). when a stack is empty,
+// objects are allocated on the heap, and
+// when it is full, returned objects are
+// left to the garbage collector.
 
 type connStack struct {
-	top  *connWrapper
-	lock uint32
+	top   *connWrapper
+	lock  uint32
+	idle  int // objects in the stack
+	max   int // capacity
+	stats poolStats
 }
 
 type waitStack struct {
-	top  *waiter
-	lock uint32
+	top   *waiter
+	lock  uint32
+	idle  int // objects in the stack
+	max   int // capacity
+	stats poolStats
 }
 
+func (s *connStack) init(max int) { s.max = max }
+
 func (s *connStack) pop() (ptr *connWrapper) {
 	spin.Lock(&s.lock)
 	if s.top != nil {
 		ptr, s.top = s.top, s.top.next
+		s.idle--
+		s.stats.hits++
 		spin.Unlock(&s.lock)
+		ptr.next = nil
 		return
 	}
+	s.stats.misses++
 	spin.Unlock(&s.lock)
-	ptr = &connWrapper{}
-	ptr.next = ptr
-	return
+	return &connWrapper{}
 }
 
 func (s *connStack) push(ptr *connWrapper) {
-	if ptr.next == ptr {
+	spin.Lock(&s.lock)
+	if s.idle >= s.max {
+		s.stats.drops++
+		spin.Unlock(&s.lock)
 		return
 	}
-	spin.Lock(&s.lock)
 	s.top, ptr.next = ptr, s.top
+	s.idle++
 	spin.Unlock(&s.lock)
 	return
 }
 
+func (s *connStack) stat() PoolStats {
+	spin.Lock(&s.lock)
+	p := s.stats.export(s.idle, s.max)
+	spin.Unlock(&s.lock)
+	return p
+}
+
+func (s *waitStack) init(max int) { s.max = max }
+
 // the following should always hold:
 //  - ptr.next = nil
 //  - ptr.parent = c
 //  - ptr.done is Lock()ed
+//  - ptr.refs = 1
 func (s *waitStack) pop(c *Client) (ptr *waiter) {
 	spin.Lock(&s.lock)
 	if s.top != nil {
 		ptr, s.top = s.top, s.top.next
+		s.idle--
+		s.stats.hits++
 		spin.Unlock(&s.lock)
 		ptr.parent = c
 		ptr.next = nil
+		ptr.refs = 1
 		return
 	}
+	s.stats.misses++
 	spin.Unlock(&s.lock)
 	ptr = &waiter{}
 	ptr.parent = c
+	ptr.refs = 1
 	return
 }
 
 func (s *waitStack) push(ptr *waiter) {
 	ptr.parent = nil
 	ptr.err = nil
-	if !ptr.static {
+	ptr.seq = 0
+	spin.Lock(&s.lock)
+	if s.idle >= s.max {
+		s.stats.drops++
+		spin.Unlock(&s.lock)
 		return
 	}
-	spin.Lock(&s.lock)
 	s.top, ptr.next = ptr, s.top
+	s.idle++
 	spin.Unlock(&s.lock)
 	return
 }
+
+func (s *waitStack) stat() PoolStats {
+	spin.Lock(&s.lock)
+	p := s.stats.export(s.idle, s.max)
+	spin.Unlock(&s.lock)
+	return p
+}
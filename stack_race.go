@@ -2,24 +2,38 @@
 
 package synapse
 
+import (
+	"sync/atomic"
+)
+
 // this file exports
 // the same interface
 // as stack.go, but
-// no-ops instead.
+// never re-uses objects.
 
-var (
-	waiters  = waitStack{}
-	wrappers = connStack{}
-)
+type waitStack struct {
+	max   int
+	stats poolStats // atomic
+}
 
-type waitStack struct{}
-type connStack struct{}
+type connStack struct {
+	max   int
+	stats poolStats // atomic
+}
 
-func (ws waitStack) push(_ *waiter) {}
-func (ws waitStack) pop(c *Client) *waiter {
-	w := &waiter{parent: c}
+func (ws *waitStack) init(max int) { ws.max = max }
+func (ws *waitStack) push(_ *waiter) { atomic.AddUint64(&ws.stats.drops, 1) }
+func (ws *waitStack) pop(c *Client) *waiter {
+	atomic.AddUint64(&ws.stats.misses, 1)
+	w := &waiter{parent: c, refs: 1}
 	return w
 }
+func (ws *waitStack) stat() PoolStats { return ws.stats.load().export(0, ws.max) }
 
-func (cs connStack) pop() *connWrapper   { return &connWrapper{} }
-func (cs connStack) push(_ *connWrapper) {}
+func (cs *connStack) init(max int) { cs.max = max }
+func (cs *connStack) pop() *connWrapper {
+	atomic.AddUint64(&cs.stats.misses, 1)
+	return &connWrapper{}
+}
+func (cs *connStack) push(_ *connWrapper) { atomic.AddUint64(&cs.stats.drops, 1) }
+func (cs *connStack) stat() PoolStats     { return cs.stats.load().export(0, cs.max) }
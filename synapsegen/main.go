@@ -0,0 +1,363 @@
+// synapsegen generates typed synapse clients
+// and servers from Go interface definitions.
+//
+// Given a file containing an interface like
+//
+//  type Arith interface {
+//      Double(ctx context.Context, in *Num) (*Num, error)
+//  }
+//
+// where *Num is a msgp.Marshaler and msgp.Unmarshaler,
+// synapsegen emits:
+//
+//  - a const block of synapse.Method IDs (ArithDouble, ...)
+//  - ArithClient, a typed client over (*synapse.Client).CallContext
+//    that implements Arith
+//  - NewArithHandler, which builds a synapse.RouteTable
+//    that dispatches calls to an implementation of Arith
+//
+// Methods are numbered in lexical order of their names,
+// which is the same numbering used by synapse.RegisterService.
+//
+// synapsegen is meant to be invoked by 'go generate':
+//
+//  //go:generate synapsegen -type=Arith
+//
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+var (
+	typeNames = flag.String("type", "", "comma-separated list of interface names; required")
+	input     = flag.String("file", os.Getenv("GOFILE"), "input file")
+	output    = flag.String("o", "", "output file; default <file>_synapse.go")
+)
+
+func main() {
+	flag.Parse()
+	if *typeNames == "" || *input == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if *output == "" {
+		*output = strings.TrimSuffix(*input, ".go") + "_synapse.go"
+	}
+
+	src, err := generate(*input, strings.Split(*typeNames, ","))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "synapsegen:", err)
+		os.Exit(1)
+	}
+	err = ioutil.WriteFile(*output, src, 0644)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "synapsegen:", err)
+		os.Exit(1)
+	}
+}
+
+// service is the template
+// input for one interface
+type service struct {
+	Name    string
+	Methods []method
+}
+
+// method is one interface method
+type method struct {
+	Name string // method name
+	In   string // request element type, e.g. Num
+	Out  string // response element type
+}
+
+type file struct {
+	Package  string
+	Imports  []string
+	Services []service
+}
+
+func generate(path string, names []string) ([]byte, error) {
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, path, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	out := file{Package: f.Name.Name}
+	used := make(map[string]bool)
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		it, err := findInterface(f, name)
+		if err != nil {
+			return nil, err
+		}
+		svc, err := parseService(fset, name, it, used)
+		if err != nil {
+			return nil, err
+		}
+		out.Services = append(out.Services, svc)
+	}
+
+	// carry over the imports
+	// used by argument types
+	found := make(map[string]bool)
+	for _, imp := range f.Imports {
+		ipath, _ := strconv.Unquote(imp.Path.Value)
+		local := importName(ipath)
+		if imp.Name != nil {
+			local = imp.Name.Name
+		}
+		if !used[local] {
+			continue
+		}
+		found[local] = true
+		if ipath == "context" || ipath == synapsePath {
+			continue
+		}
+		if imp.Name != nil {
+			out.Imports = append(out.Imports, imp.Name.Name+" "+imp.Path.Value)
+		} else {
+			out.Imports = append(out.Imports, imp.Path.Value)
+		}
+	}
+
+	// a package's name can't always be told
+	// from its import path, so an import that
+	// doesn't match needs an alias
+	var missing []string
+	for name := range used {
+		if !found[name] {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return nil, fmt.Errorf("%s: no import matches %s; give the import an alias", path, strings.Join(missing, ", "))
+	}
+
+	var buf bytes.Buffer
+	err = tmpl.Execute(&buf, &out)
+	if err != nil {
+		return nil, err
+	}
+	return format.Source(buf.Bytes())
+}
+
+func findInterface(f *ast.File, name string) (*ast.InterfaceType, error) {
+	for _, decl := range f.Decls {
+		gd, ok := decl.(*ast.GenDecl)
+		if !ok || gd.Tok != token.TYPE {
+			continue
+		}
+		for _, spec := range gd.Specs {
+			ts := spec.(*ast.TypeSpec)
+			if ts.Name.Name != name {
+				continue
+			}
+			it, ok := ts.Type.(*ast.InterfaceType)
+			if !ok {
+				return nil, fmt.Errorf("%s is not an interface", name)
+			}
+			return it, nil
+		}
+	}
+	return nil, fmt.Errorf("interface %s not found", name)
+}
+
+func parseService(fset *token.FileSet, name string, it *ast.InterfaceType, used map[string]bool) (service, error) {
+	svc := service{Name: name}
+	for _, field := range it.Methods.List {
+		ft, ok := field.Type.(*ast.FuncType)
+		if !ok || len(field.Names) != 1 {
+			return svc, fmt.Errorf("%s: embedded interfaces are not supported", fset.Position(field.Pos()))
+		}
+		mname := field.Names[0].Name
+		pos := fset.Position(field.Pos())
+		params := flatten(ft.Params)
+		results := flatten(ft.Results)
+		if len(params) != 2 || len(results) != 2 {
+			return svc, fmt.Errorf("%s: %s.%s must have the form func(context.Context, *In) (*Out, error)", pos, name, mname)
+		}
+		if types.ExprString(params[0]) != "context.Context" || types.ExprString(results[1]) != "error" {
+			return svc, fmt.Errorf("%s: %s.%s must have the form func(context.Context, *In) (*Out, error)", pos, name, mname)
+		}
+		in, ok := params[1].(*ast.StarExpr)
+		if !ok {
+			return svc, fmt.Errorf("%s: %s.%s: argument must be a pointer", pos, name, mname)
+		}
+		out, ok := results[0].(*ast.StarExpr)
+		if !ok {
+			return svc, fmt.Errorf("%s: %s.%s: result must be a pointer", pos, name, mname)
+		}
+		markUsed(in.X, used)
+		markUsed(out.X, used)
+		svc.Methods = append(svc.Methods, method{
+			Name: mname,
+			In:   types.ExprString(in.X),
+			Out:  types.ExprString(out.X),
+		})
+	}
+	if len(svc.Methods) == 0 {
+		return svc, fmt.Errorf("interface %s has no methods", name)
+	}
+	// match the numbering used
+	// by synapse.RegisterService
+	sort.Slice(svc.Methods, func(i, j int) bool {
+		return svc.Methods[i].Name < svc.Methods[j].Name
+	})
+	return svc, nil
+}
+
+// flatten expands grouped fields
+// like (a, b *T) into one expression
+// per name
+func flatten(fl *ast.FieldList) []ast.Expr {
+	if fl == nil {
+		return nil
+	}
+	var out []ast.Expr
+	for _, f := range fl.List {
+		n := len(f.Names)
+		if n == 0 {
+			n = 1
+		}
+		for i := 0; i < n; i++ {
+			out = append(out, f.Type)
+		}
+	}
+	return out
+}
+
+// importName returns the name of the package
+// at 'path' if it follows the usual conventions:
+// the last element of the path, without a major
+// version suffix like "/v2" or gopkg.in's ".v2"
+func importName(path string) string {
+	elems := strings.Split(path, "/")
+	name := elems[len(elems)-1]
+	if len(elems) > 1 && isVersion(name) {
+		name = elems[len(elems)-2]
+	}
+	if i := strings.LastIndex(name, "."); i > 0 && isVersion(name[i+1:]) {
+		name = name[:i]
+	}
+	return name
+}
+
+// isVersion returns whether 's'
+// is a major version like "v2"
+func isVersion(s string) bool {
+	if len(s) < 2 || s[0] != 'v' {
+		return false
+	}
+	for _, c := range s[1:] {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// markUsed records the package
+// qualifiers referenced by 'e'
+func markUsed(e ast.Expr, used map[string]bool) {
+	ast.Inspect(e, func(n ast.Node) bool {
+		if sel, ok := n.(*ast.SelectorExpr); ok {
+			if id, ok := sel.X.(*ast.Ident); ok {
+				used[id.Name] = true
+			}
+		}
+		return true
+	})
+}
+
+const synapsePath = "github.com/tinylib/synapse"
+
+var tmpl = template.Must(template.New("synapse").Parse(`// Code generated by synapsegen; DO NOT EDIT.
+
+package {{ .Package }}
+
+import (
+	"context"
+
+	"github.com/tinylib/synapse"
+{{- range .Imports }}
+	{{ . }}
+{{- end }}
+)
+{{ range .Services }}{{ $svc := .Name }}
+// Method IDs for {{ $svc }}. These match the
+// numbering used by synapse.RegisterService.
+const (
+{{- range $i, $m := .Methods }}
+	{{ $svc }}{{ $m.Name }}{{ if eq $i 0 }} synapse.Method = iota{{ end }}
+{{- end }}
+)
+
+// {{ $svc }}Client calls {{ $svc }}
+// methods on a remote server.
+type {{ $svc }}Client struct {
+	c *synapse.Client
+}
+
+// New{{ $svc }}Client returns a client
+// for {{ $svc }} that makes calls using 'c'.
+func New{{ $svc }}Client(c *synapse.Client) *{{ $svc }}Client {
+	return &{{ $svc }}Client{c: c}
+}
+
+var _ {{ $svc }} = (*{{ $svc }}Client)(nil)
+{{ range .Methods }}
+// {{ .Name }} calls {{ $svc }}.{{ .Name }} on the server.
+func (c *{{ $svc }}Client) {{ .Name }}(ctx context.Context, in *{{ .In }}) (*{{ .Out }}, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	out := new({{ .Out }})
+	err := c.c.CallContext(ctx, {{ $svc }}{{ .Name }}, in, out)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+{{ end }}
+// New{{ $svc }}Handler returns a synapse.Handler
+// that dispatches calls to 'impl'.
+func New{{ $svc }}Handler(impl {{ $svc }}) synapse.Handler {
+	return &synapse.RouteTable{
+{{- range .Methods }}
+		{{ $svc }}{{ .Name }}: synapse.HandlerFunc(func(req synapse.Request, res synapse.ResponseWriter) {
+			in := new({{ .In }})
+			if err := req.Decode(in); err != nil {
+				res.Error(synapse.StatusBadRequest, err.Error())
+				return
+			}
+			out, err := impl.{{ .Name }}(synapse.RequestContext(req), in)
+			if err != nil {
+				synapse.SendError(res, err)
+				return
+			}
+			if out == nil {
+				res.Send(nil)
+				return
+			}
+			res.Send(out)
+		}),
+{{- end }}
+	}
+}
+{{ end }}`))
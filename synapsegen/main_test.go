@@ -0,0 +1,112 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testSrc = `package svc
+
+import (
+	"context"
+
+	"example.com/types"
+)
+
+type Svc interface {
+	Sub(ctx context.Context, in *types.Pair) (*types.Num, error)
+	Add(ctx context.Context, in *types.Pair) (*types.Num, error)
+}
+
+type Bad interface {
+	Add(in *types.Pair) (*types.Num, error)
+}
+`
+
+func writeSrc(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "synapsegen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := filepath.Join(dir, "svc.go")
+	err = ioutil.WriteFile(name, []byte(testSrc), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return name
+}
+
+func TestGenerate(t *testing.T) {
+	name := writeSrc(t)
+	defer os.RemoveAll(filepath.Dir(name))
+
+	out, err := generate(name, []string{"Svc"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := string(out)
+	for _, want := range []string{
+		"SvcAdd synapse.Method = iota\n\tSvcSub\n",
+		"\"example.com/types\"",
+		"func (c *SvcClient) Sub(ctx context.Context, in *types.Pair) (*types.Num, error)",
+		"func NewSvcHandler(impl Svc) synapse.Handler",
+		"c.c.CallContext(ctx, SvcSub, in, out)",
+	} {
+		if !strings.Contains(src, want) {
+			t.Errorf("output doesn't contain %q:\n%s", want, src)
+		}
+	}
+
+	_, err = generate(name, []string{"Bad"})
+	if err == nil {
+		t.Error("expected an error for an interface with a bad method signature")
+	}
+}
+
+func TestImportNames(t *testing.T) {
+	for path, want := range map[string]string{
+		"example.com/types":             "types",
+		"github.com/tinylib/msgp/v5":    "msgp",
+		"gopkg.in/yaml.v2":              "yaml",
+		"example.com/pkg.v3/v4":         "pkg",
+		"context":                       "context",
+		"example.com/versions/vendored": "vendored",
+	} {
+		if got := importName(path); got != want {
+			t.Errorf("importName(%q) = %q; want %q", path, got, want)
+		}
+	}
+}
+
+func TestGenerateVersionedImport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "synapsegen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src := strings.Replace(testSrc, `"example.com/types"`, `"example.com/types/v2"`, 1)
+	name := filepath.Join(dir, "svc.go")
+	if err := ioutil.WriteFile(name, []byte(src), 0644); err != nil {
+		t.Fatal(err)
+	}
+	out, err := generate(name, []string{"Svc"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(out), `"example.com/types/v2"`) {
+		t.Errorf("output doesn't import example.com/types/v2:\n%s", out)
+	}
+
+	// a package name that can't be
+	// told from the path needs an alias
+	src = strings.Replace(testSrc, `"example.com/types"`, `"example.com/go-types"`, 1)
+	if err := ioutil.WriteFile(name, []byte(src), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := generate(name, []string{"Svc"}); err == nil {
+		t.Error("expected an error for an import without an alias")
+	}
+}
@@ -0,0 +1,336 @@
+package synapse
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"os"
+	"sync"
+	"time"
+)
+
+// reloadInterval is the minimum time
+// between checks for changed certificates
+const reloadInterval = time.Second
+
+// CertReloader serves a certificate and key
+// from a pair of PEM files, and reloads them
+// when the files change, so that certificates
+// can be rotated without restarting. The files
+// are checked at most once per second, during
+// TLS handshakes. If the new files can't be
+// loaded (for instance, because only one of
+// them has been replaced so far), the old
+// certificate is kept.
+type CertReloader struct {
+	certFile, keyFile string
+
+	lock    sync.Mutex
+	cert    *tls.Certificate
+	stamp   fileStamp // of the loaded files
+	checked time.Time // time of the last check
+}
+
+// fileStamp identifies a
+// version of a pair of files
+type fileStamp struct {
+	cmod, kmod   time.Time
+	csize, ksize int64
+}
+
+func stampFiles(certFile, keyFile string) (fileStamp, error) {
+	c, err := os.Stat(certFile)
+	if err != nil {
+		return fileStamp{}, err
+	}
+	k, err := os.Stat(keyFile)
+	if err != nil {
+		return fileStamp{}, err
+	}
+	return fileStamp{cmod: c.ModTime(), kmod: k.ModTime(), csize: c.Size(), ksize: k.Size()}, nil
+}
+
+// NewCertReloader loads a certificate and
+// its private key from a pair of PEM files.
+// See tls.LoadX509KeyPair.
+func NewCertReloader(certFile, keyFile string) (*CertReloader, error) {
+	r := &CertReloader{certFile: certFile, keyFile: keyFile}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reload loads the files immediately. If
+// it returns an error, the old certificate
+// is kept.
+func (r *CertReloader) Reload() error {
+	st, err := stampFiles(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	r.lock.Lock()
+	r.cert, r.stamp, r.checked = &cert, st, time.Now()
+	r.lock.Unlock()
+	return nil
+}
+
+// current returns the current certificate,
+// reloading it if the files have changed
+func (r *CertReloader) current() *tls.Certificate {
+	now := time.Now()
+	r.lock.Lock()
+	if now.Sub(r.checked) >= reloadInterval {
+		r.checked = now
+		st, err := stampFiles(r.certFile, r.keyFile)
+		if err == nil && st != r.stamp {
+			cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+			if err == nil {
+				r.cert, r.stamp = &cert, st
+			}
+		}
+	}
+	c := r.cert
+	r.lock.Unlock()
+	return c
+}
+
+// GetCertificate can be used as
+// tls.Config.GetCertificate.
+func (r *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return r.current(), nil
+}
+
+// GetClientCertificate can be used as
+// tls.Config.GetClientCertificate.
+func (r *CertReloader) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return r.current(), nil
+}
+
+var (
+	errNoCA         = errors.New("synapse: no CA certificates")
+	errNoServerName = errors.New("synapse: tls.Config.ServerName must be set")
+	errNoServerCert = errors.New("synapse: the server didn't present a certificate")
+)
+
+// loadCAs reads a pool of
+// PEM-encoded CA certificates
+func loadCAs(caFile string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errNoCA
+	}
+	return pool, nil
+}
+
+// caReloader is a pool of CA certificates
+// that is reloaded when its file changes,
+// like CertReloader
+type caReloader struct {
+	file string
+
+	lock    sync.Mutex
+	pool    *x509.CertPool
+	stamp   fileStamp
+	checked time.Time
+}
+
+func newCAReloader(file string) (*caReloader, error) {
+	st, err := stampFiles(file, file)
+	if err != nil {
+		return nil, err
+	}
+	pool, err := loadCAs(file)
+	if err != nil {
+		return nil, err
+	}
+	return &caReloader{file: file, pool: pool, stamp: st, checked: time.Now()}, nil
+}
+
+// current returns the current pool,
+// reloading it if the file has changed
+func (c *caReloader) current() *x509.CertPool {
+	now := time.Now()
+	c.lock.Lock()
+	if now.Sub(c.checked) >= reloadInterval {
+		c.checked = now
+		st, err := stampFiles(c.file, c.file)
+		if err == nil && st != c.stamp {
+			pool, err := loadCAs(c.file)
+			if err == nil {
+				c.pool, c.stamp = pool, st
+			}
+		}
+	}
+	p := c.pool
+	c.lock.Unlock()
+	return p
+}
+
+// verifyServer verifies the certificates
+// of a server against the current pool,
+// the way that crypto/tls would if the
+// pool were the config's RootCAs
+func (c *caReloader) verifyServer(cs tls.ConnectionState) error {
+	if cs.ServerName == "" {
+		return errNoServerName
+	}
+	if len(cs.PeerCertificates) == 0 {
+		return errNoServerCert
+	}
+	opts := x509.VerifyOptions{
+		Roots:         c.current(),
+		DNSName:       cs.ServerName,
+		Intermediates: x509.NewCertPool(),
+	}
+	for _, cert := range cs.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	_, err := cs.PeerCertificates[0].Verify(opts)
+	return err
+}
+
+// ServerTLSConfig returns a TLS configuration
+// for a server that presents the certificate
+// in certFile and keyFile, and requires clients
+// to present certificates signed by one of the
+// CAs in caFile. The certificate and the CAs
+// are reloaded when the files change. The CAs
+// are set for each handshake by
+// GetConfigForClient, so setting ClientCAs
+// has no effect.
+func ServerTLSConfig(certFile, keyFile, caFile string) (*tls.Config, error) {
+	r, err := NewCertReloader(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	cas, err := newCAReloader(caFile)
+	if err != nil {
+		return nil, err
+	}
+	conf := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: r.GetCertificate,
+		ClientAuth:     tls.RequireAndVerifyClientCert,
+		ClientCAs:      cas.current(),
+	}
+	conf.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		c := conf.Clone()
+		c.ClientCAs = cas.current()
+		return c, nil
+	}
+	return conf, nil
+}
+
+// ClientTLSConfig returns a TLS configuration
+// for a client that presents the certificate
+// in certFile and keyFile, and requires servers
+// to present certificates signed by one of the
+// CAs in caFile. If caFile is empty, the system's
+// CAs are used. The certificate and the CAs are
+// reloaded when the files change.
+//
+// If caFile is not empty, the server's certificate
+// is verified by VerifyConnection rather than by
+// crypto/tls, so InsecureSkipVerify is set, and
+// RootCAs has no effect. ServerName must be set
+// (DialTLS and tls.Dial set it from the address).
+func ClientTLSConfig(certFile, keyFile, caFile string) (*tls.Config, error) {
+	r, err := NewCertReloader(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	conf := &tls.Config{
+		MinVersion:           tls.VersionTLS12,
+		GetClientCertificate: r.GetClientCertificate,
+	}
+	if caFile != "" {
+		cas, err := newCAReloader(caFile)
+		if err != nil {
+			return nil, err
+		}
+		conf.InsecureSkipVerify = true
+		conf.VerifyConnection = cas.verifyServer
+	}
+	return conf, nil
+}
+
+// ListenAndServeMutualTLS is like ListenAndServeTLS,
+// except that clients must present certificates
+// signed by one of the CAs in caFile. Handlers
+// can get the identity of the client with
+// PeerIdentity. See ServerTLSConfig.
+func ListenAndServeMutualTLS(network, laddr string, certFile, keyFile, caFile string, h Handler, opts ...Option) error {
+	conf, err := ServerTLSConfig(certFile, keyFile, caFile)
+	if err != nil {
+		return err
+	}
+	l, err := tls.Listen(network, laddr, conf)
+	if err != nil {
+		return err
+	}
+	return Serve(l, h, opts...)
+}
+
+// DialMutualTLS is like DialTLS, except that
+// the client presents the certificate in
+// certFile and keyFile, and the server must
+// present a certificate signed by one of the
+// CAs in caFile. See ClientTLSConfig.
+func DialMutualTLS(network, raddr string, timeout time.Duration, certFile, keyFile, caFile string, opts ...Option) (*Client, error) {
+	conf, err := ClientTLSConfig(certFile, keyFile, caFile)
+	if err != nil {
+		return nil, err
+	}
+	return DialTLS(network, raddr, timeout, conf, opts...)
+}
+
+// PeerCertificate returns the verified
+// certificate of the client that sent a
+// request, or nil if the client didn't
+// present one or the server didn't
+// verify it.
+func PeerCertificate(req Request) *x509.Certificate {
+	cs := RequestTLS(req)
+	if cs == nil || len(cs.VerifiedChains) == 0 || len(cs.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return cs.VerifiedChains[0][0]
+}
+
+// PeerIdentity returns the identity in
+// the verified certificate of the client
+// that sent a request. The subject is the
+// certificate's common name or, if that is
+// empty, its first URI, email address or DNS
+// name, in that order. The subject is empty
+// if the certificate has none of these.
+func PeerIdentity(req Request) (Identity, bool) {
+	cert := PeerCertificate(req)
+	if cert == nil {
+		return Identity{}, false
+	}
+	return Identity{Scheme: "tls", Subject: certSubject(cert), Cert: cert}, true
+}
+
+func certSubject(cert *x509.Certificate) string {
+	switch {
+	case cert.Subject.CommonName != "":
+		return cert.Subject.CommonName
+	case len(cert.URIs) > 0:
+		return cert.URIs[0].String()
+	case len(cert.EmailAddresses) > 0:
+		return cert.EmailAddresses[0]
+	case len(cert.DNSNames) > 0:
+		return cert.DNSNames[0]
+	}
+	return ""
+}
@@ -0,0 +1,238 @@
+package synapse
+
+import (
+	"crypto/ecdsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writePEM writes a certificate and key
+// to 'name'.crt and 'name'.key in 'dir'
+func writePEM(t *testing.T, dir, name string, cert tls.Certificate) (string, string) {
+	crt := filepath.Join(dir, name+".crt")
+	key := filepath.Join(dir, name+".key")
+	der, err := x509.MarshalECPrivateKey(cert.PrivateKey.(*ecdsa.PrivateKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(crt, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(key, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return crt, key
+}
+
+func (ca *testCA) write(t *testing.T, dir string) string {
+	name := filepath.Join(dir, "ca.crt")
+	err := os.WriteFile(name, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return name
+}
+
+func commonName(t *testing.T, c *tls.Certificate) string {
+	cert, err := x509.ParseCertificate(c.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert.Subject.CommonName
+}
+
+func TestCertReloader(t *testing.T) {
+	ca := newTestCA(t)
+	dir := t.TempDir()
+	crt, key := writePEM(t, dir, "server", ca.issue(t, "first"))
+	r, err := NewCertReloader(crt, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, _ := r.GetCertificate(nil)
+	if n := commonName(t, c); n != "first" {
+		t.Fatalf("expected 'first'; got %q", n)
+	}
+
+	// replace the files, and make sure
+	// the modification time changes
+	writePEM(t, dir, "server", ca.issue(t, "second"))
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(crt, later, later)
+	os.Chtimes(key, later, later)
+
+	// too soon to check again
+	c, _ = r.GetCertificate(nil)
+	if n := commonName(t, c); n != "first" {
+		t.Errorf("expected 'first' before the reload interval; got %q", n)
+	}
+	r.lock.Lock()
+	r.checked = time.Time{}
+	r.lock.Unlock()
+	c, _ = r.GetCertificate(nil)
+	if n := commonName(t, c); n != "second" {
+		t.Errorf("expected 'second' after the files changed; got %q", n)
+	}
+
+	// a broken key keeps the old certificate
+	os.WriteFile(key, []byte("garbage"), 0600)
+	r.lock.Lock()
+	r.checked = time.Time{}
+	r.lock.Unlock()
+	c, _ = r.GetClientCertificate(nil)
+	if n := commonName(t, c); n != "second" {
+		t.Errorf("expected 'second' to be kept; got %q", n)
+	}
+	if r.Reload() == nil {
+		t.Error("expected Reload to fail")
+	}
+}
+
+func TestMutualTLS(t *testing.T) {
+	ca := newTestCA(t)
+	dir := t.TempDir()
+	cafile := ca.write(t, dir)
+	scrt, skey := writePEM(t, dir, "server", ca.issue(t, "localhost"))
+	ccrt, ckey := writePEM(t, dir, "client", ca.issue(t, "dave"))
+
+	conf, err := ServerTLSConfig(scrt, skey, cafile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := tls.Listen("tcp", "127.0.0.1:0", conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	addr := net.JoinHostPort("localhost", port)
+	go Serve(l, HandlerFunc(func(req Request, res ResponseWriter) {
+		id, ok := PeerIdentity(req)
+		if !ok {
+			res.Error(StatusNotAuthed, "no certificate")
+			return
+		}
+		s := testString(id.Subject)
+		res.Send(&s)
+	}))
+
+	cl, err := DialMutualTLS("tcp", addr, time.Second, ccrt, ckey, cafile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cl.Close()
+	var out testString
+	if err := cl.Call(Echo, nil, &out); err != nil {
+		t.Fatal(err)
+	}
+	if out != "dave" {
+		t.Errorf("expected 'dave'; got %q", out)
+	}
+
+	// a client without a certificate
+	// can't complete the handshake
+	cconf, err := ClientTLSConfig(ccrt, ckey, cafile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cconf.GetClientCertificate = nil
+	if cl, err := DialTLS("tcp", addr, time.Second, cconf); err == nil {
+		cl.Close()
+		t.Error("expected the handshake to fail")
+	}
+}
+
+// a peer that never sends a ClientHello
+// shouldn't hold on to the connection
+func TestTLSHandshakeTimeout(t *testing.T) {
+	defer func(d time.Duration) { tlsHandshakeTimeout = d }(tlsHandshakeTimeout)
+	tlsHandshakeTimeout = 20 * time.Millisecond
+
+	ca := newTestCA(t)
+	srv, cln := net.Pipe()
+	defer cln.Close()
+	done := make(chan struct{})
+	go func() {
+		ServeConn(tls.Server(srv, &tls.Config{
+			Certificates: []tls.Certificate{ca.issue(t, "server")},
+		}), EchoHandler{})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("ServeConn is still waiting for the handshake")
+	}
+}
+
+func writeCAs(t *testing.T, name string, cas ...*testCA) {
+	var buf []byte
+	for _, ca := range cas {
+		buf = append(buf, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw})...)
+	}
+	if err := os.WriteFile(name, buf, 0600); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(name, later, later)
+}
+
+// both sides pick up a new
+// CA file without restarting
+func TestCAReload(t *testing.T) {
+	ca1, ca2 := newTestCA(t), newTestCA(t)
+	dir := t.TempDir()
+	scas := filepath.Join(dir, "server-cas.crt")
+	ccas := filepath.Join(dir, "client-cas.crt")
+	writeCAs(t, scas, ca2)
+	writeCAs(t, ccas, ca2)
+	// the certificates are signed by
+	// the CA that neither side trusts
+	scrt, skey := writePEM(t, dir, "server", ca1.issue(t, "localhost"))
+	ccrt, ckey := writePEM(t, dir, "client", ca1.issue(t, "dave"))
+
+	conf, err := ServerTLSConfig(scrt, skey, scas)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := tls.Listen("tcp", "127.0.0.1:0", conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	addr := net.JoinHostPort("localhost", port)
+	go Serve(l, EchoHandler{})
+
+	cconf, err := ClientTLSConfig(ccrt, ckey, ccas)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cl, err := DialTLS("tcp", addr, time.Second, cconf); err == nil {
+		cl.Close()
+		t.Fatal("expected the handshake to fail")
+	}
+
+	writeCAs(t, scas, ca1, ca2)
+	writeCAs(t, ccas, ca1, ca2)
+	time.Sleep(reloadInterval)
+	cl, err := DialTLS("tcp", addr, time.Second, cconf)
+	if err != nil {
+		t.Fatalf("expected the new CAs to be loaded: %v", err)
+	}
+	cl.Close()
+
+	// the server's name is still checked
+	if cl, err := DialTLS("tcp", l.Addr().String(), time.Second, cconf); err == nil {
+		cl.Close()
+		t.Error("expected a certificate for localhost not to match 127.0.0.1")
+	}
+}
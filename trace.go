@@ -0,0 +1,355 @@
+package synapse
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/tinylib/msgp/msgp"
+)
+
+// metadata keys used for trace
+// propagation; see the W3C Trace
+// Context specification
+const (
+	traceparentKey = "traceparent"
+	tracestateKey  = "tracestate"
+)
+
+// TraceID identifies a trace.
+type TraceID [16]byte
+
+// SpanID identifies a span.
+type SpanID [8]byte
+
+func (t TraceID) String() string { return hex.EncodeToString(t[:]) }
+func (s SpanID) String() string  { return hex.EncodeToString(s[:]) }
+
+// SpanContext is the part of a span
+// that is propagated across calls.
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	Flags   byte   // trace flags; bit 0 is 'sampled'
+	State   string // vendor-specific 'tracestate', passed through unchanged
+}
+
+// IsValid returns whether or not
+// both the trace and span ID are set.
+func (s SpanContext) IsValid() bool {
+	return s.TraceID != TraceID{} && s.SpanID != SpanID{}
+}
+
+// Traceparent returns the W3C
+// 'traceparent' value for 's'.
+func (s SpanContext) Traceparent() string {
+	b := make([]byte, 0, 55)
+	b = append(b, "00-"...)
+	b = appendHex(b, s.TraceID[:])
+	b = append(b, '-')
+	b = appendHex(b, s.SpanID[:])
+	b = append(b, '-')
+	b = appendHex(b, []byte{s.Flags})
+	return string(b)
+}
+
+func appendHex(dst, src []byte) []byte {
+	n := len(dst)
+	dst = append(dst, make([]byte, hex.EncodedLen(len(src)))...)
+	hex.Encode(dst[n:], src)
+	return dst
+}
+
+var errTraceparent = errors.New("synapse: malformed traceparent")
+
+// ParseTraceparent parses a W3C
+// 'traceparent' value. The State of
+// the returned SpanContext is empty.
+func ParseTraceparent(s string) (SpanContext, error) {
+	var sc SpanContext
+	// version-traceid-spanid-flags; future
+	// versions may append more fields
+	if len(s) < 55 || s[2] != '-' || s[35] != '-' || s[52] != '-' ||
+		(len(s) > 55 && s[55] != '-') {
+		return sc, errTraceparent
+	}
+	// hex.Decode accepts upper case,
+	// but the spec only allows lower case
+	for i := 0; i < 55; i++ {
+		if s[i] >= 'A' && s[i] <= 'F' {
+			return sc, errTraceparent
+		}
+	}
+	var ver [1]byte
+	if _, err := hex.Decode(ver[:], []byte(s[0:2])); err != nil || ver[0] == 0xff ||
+		(ver[0] == 0 && len(s) != 55) {
+		return sc, errTraceparent
+	}
+	if _, err := hex.Decode(sc.TraceID[:], []byte(s[3:35])); err != nil {
+		return sc, errTraceparent
+	}
+	if _, err := hex.Decode(sc.SpanID[:], []byte(s[36:52])); err != nil {
+		return sc, errTraceparent
+	}
+	var flags [1]byte
+	if _, err := hex.Decode(flags[:], []byte(s[53:55])); err != nil {
+		return sc, errTraceparent
+	}
+	sc.Flags = flags[0]
+	if !sc.IsValid() {
+		return sc, errTraceparent
+	}
+	return sc, nil
+}
+
+type spanKey struct{}
+
+// ContextWithSpan returns a copy of
+// 'ctx' carrying 's'. Calls made with
+// (*Client).CallContext by a client with
+// the TraceCalls interceptor are children
+// of the span in their context.
+func ContextWithSpan(ctx context.Context, s SpanContext) context.Context {
+	return context.WithValue(ctx, spanKey{}, s)
+}
+
+// SpanFromContext returns the
+// span in 'ctx', if there is one.
+// Handlers wrapped with Tracing can
+// use it on RequestContext(req).
+func SpanFromContext(ctx context.Context) (SpanContext, bool) {
+	s, ok := ctx.Value(spanKey{}).(SpanContext)
+	return s, ok
+}
+
+// SpanKind distinguishes client
+// spans from server spans.
+type SpanKind int
+
+const (
+	SpanClient SpanKind = iota // the client side of a call
+	SpanServer                 // the server side of a call
+)
+
+func (k SpanKind) String() string {
+	if k == SpanClient {
+		return "client"
+	}
+	return "server"
+}
+
+// Span describes one side of a call.
+type Span struct {
+	Kind    SpanKind
+	Name    string      // name of the method
+	Method  Method      // method called
+	Context SpanContext // this span
+	Parent  SpanID      // parent span; zero for the root of a trace
+	Remote  string      // remote address, for server spans
+	Start   time.Time   // when the call started
+	End     time.Time   // when the call finished
+	Status  Status      // result of the call
+	Err     error       // error returned by the call, for client spans
+}
+
+// An Exporter receives finished spans.
+// Export is called from the goroutine
+// that made or served the call, so it
+// should not block, and it must be safe
+// to call concurrently. The span must not
+// be modified or retained after Export
+// returns; implementations should copy it.
+type Exporter interface {
+	Export(s *Span)
+}
+
+// MemoryExporter is an Exporter that
+// keeps spans in memory. It is intended
+// for tests. The zero value is ready to use.
+type MemoryExporter struct {
+	lock  sync.Mutex
+	spans []Span
+}
+
+// Export implements Exporter
+func (m *MemoryExporter) Export(s *Span) {
+	m.lock.Lock()
+	m.spans = append(m.spans, *s)
+	m.lock.Unlock()
+}
+
+// Spans returns a copy of the spans
+// exported so far, in order.
+func (m *MemoryExporter) Spans() []Span {
+	m.lock.Lock()
+	out := make([]Span, len(m.spans))
+	copy(out, m.spans)
+	m.lock.Unlock()
+	return out
+}
+
+// Reset discards every span.
+func (m *MemoryExporter) Reset() {
+	m.lock.Lock()
+	m.spans = nil
+	m.lock.Unlock()
+}
+
+func newTraceID() (t TraceID) {
+	for t == (TraceID{}) {
+		rand.Read(t[:])
+	}
+	return t
+}
+
+func newSpanID() (s SpanID) {
+	for s == (SpanID{}) {
+		rand.Read(s[:])
+	}
+	return s
+}
+
+// child returns a new span context
+// that is a child of 'parent', or the
+// root of a new (sampled) trace if
+// 'parent' isn't valid
+func child(parent SpanContext) SpanContext {
+	if !parent.IsValid() {
+		return SpanContext{TraceID: newTraceID(), SpanID: newSpanID(), Flags: 1}
+	}
+	parent.SpanID = newSpanID()
+	return parent
+}
+
+// TraceCalls returns an Interceptor that
+// records a client span for each call and
+// exports it to 'e'. The span is a child of
+// the span in the call's context (see
+// ContextWithSpan), if there is one, and it
+// is propagated to the server in the request
+// metadata as W3C 'traceparent' and
+// 'tracestate' values.
+func TraceCalls(e Exporter) Interceptor {
+	return func(next Invoker) Invoker {
+		return func(ctx context.Context, method Method, in msgp.Marshaler, out msgp.Unmarshaler) error {
+			parent, _ := SpanFromContext(ctx)
+			sc := child(parent)
+			md := Metadata{traceparentKey: sc.Traceparent()}
+			if sc.State != "" {
+				md[tracestateKey] = sc.State
+			}
+			ctx = WithMetadata(ContextWithSpan(ctx, sc), md)
+
+			s := Span{
+				Kind:    SpanClient,
+				Name:    method.String(),
+				Method:  method,
+				Context: sc,
+				Start:   time.Now(),
+			}
+			if parent.IsValid() {
+				s.Parent = parent.SpanID
+			}
+			err := next(ctx, method, in, out)
+			s.End = time.Now()
+			s.Status = callStatus(err)
+			s.Err = err
+			e.Export(&s)
+			return err
+		}
+	}
+}
+
+// Tracing returns a Middleware that records
+// a server span for each request and exports
+// it to 'e'. The span continues the trace in
+// the request metadata, if there is one. The
+// span is available to the wrapped handler
+// through SpanFromContext(RequestContext(req)),
+// so that calls the handler makes with a traced
+// client are part of the same trace.
+func Tracing(e Exporter) Middleware {
+	return func(h Handler) Handler {
+		return &traceh{inner: h, exp: e}
+	}
+}
+
+type traceh struct {
+	inner Handler
+	exp   Exporter
+}
+
+// Methods implements MethodLister
+// if the wrapped handler does.
+func (t *traceh) Methods() []MethodInfo { return HandlerMethods(t.inner) }
+
+func (t *traceh) ServeCall(req Request, res ResponseWriter) {
+	md := RequestMetadata(req)
+	parent, err := ParseTraceparent(md[traceparentKey])
+	if err == nil {
+		parent.State = md[tracestateKey]
+	}
+	sc := child(parent)
+	s := Span{
+		Kind:    SpanServer,
+		Name:    req.Method().String(),
+		Method:  req.Method(),
+		Context: sc,
+		Start:   time.Now(),
+	}
+	if parent.IsValid() {
+		s.Parent = parent.SpanID
+	}
+	if addr := req.RemoteAddr(); addr != nil {
+		s.Remote = addr.String()
+	}
+
+	tw := statusWriter{ResponseWriter: res, status: StatusOK}
+	ctx := ContextWithSpan(RequestContext(req), sc)
+	t.inner.ServeCall(RequestWithContext(req, ctx), &tw)
+	s.End = time.Now()
+	s.Status = tw.status
+	t.exp.Export(&s)
+}
+
+// statusWriter records the status
+// of the response written to it
+type statusWriter struct {
+	ResponseWriter
+	status Status
+	wrote  bool
+}
+
+func (s *statusWriter) Send(m msgp.Marshaler) error {
+	if !s.wrote {
+		s.wrote = true
+		s.status = StatusOK
+	}
+	return s.ResponseWriter.Send(m)
+}
+
+func (s *statusWriter) Error(st Status, expl string) {
+	if !s.wrote {
+		s.wrote = true
+		s.status = st
+	}
+	s.ResponseWriter.Error(st, expl)
+}
+
+// WriteError implements ErrorWriter,
+// so SendError keeps working through
+// the wrapper
+func (s *statusWriter) WriteError(e *ResponseError) {
+	if !s.wrote {
+		s.wrote = true
+		s.status = e.Code
+	}
+	if ew, ok := s.ResponseWriter.(ErrorWriter); ok {
+		ew.WriteError(e)
+	} else {
+		s.ResponseWriter.Error(e.Code, e.Expl)
+	}
+}
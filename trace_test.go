@@ -0,0 +1,122 @@
+package synapse
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/tinylib/msgp/msgp"
+)
+
+func TestTraceparent(t *testing.T) {
+	const tp = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	sc, err := ParseTraceparent(tp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sc.TraceID.String() != "4bf92f3577b34da6a3ce929d0e0e4736" ||
+		sc.SpanID.String() != "00f067aa0ba902b7" || sc.Flags != 1 {
+		t.Errorf("parsed %+v", sc)
+	}
+	if out := sc.Traceparent(); out != tp {
+		t.Errorf("round-trip produced %q", out)
+	}
+
+	for _, bad := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e473x-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00F067AA0BA902B7-01",
+	} {
+		if _, err := ParseTraceparent(bad); err == nil {
+			t.Errorf("expected %q to be rejected", bad)
+		}
+	}
+	// future versions may have more fields
+	if _, err := ParseTraceparent("01" + tp[2:] + "-extra"); err != nil {
+		t.Errorf("future version: %s", err)
+	}
+}
+
+// client -> front -> back, with
+// every hop traced
+func TestTracing(t *testing.T) {
+	var spans MemoryExporter
+
+	bsrv, bcln := net.Pipe()
+	go ServeConn(bsrv, Tracing(&spans)(&RouteTable{Echo: EchoHandler{}, Fail: FailHandler{}}))
+	back, err := NewClient(bcln, time.Second, Intercept(TraceCalls(&spans)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer back.Close()
+
+	front := HandlerFunc(func(req Request, res ResponseWriter) {
+		var out msgp.Raw
+		err := back.CallContext(RequestContext(req), req.Method(), msgp.Raw(req.(RawRequest).Body()), &out)
+		if err != nil {
+			SendError(res, err)
+			return
+		}
+		res.Send(out)
+	})
+	fsrv, fcln := net.Pipe()
+	go ServeConn(fsrv, Tracing(&spans)(front))
+	cl, err := NewClient(fcln, time.Second, Intercept(TraceCalls(&spans)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cl.Close()
+
+	in := testData("traced")
+	if err := cl.Call(Echo, &in, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// spans are exported as they finish,
+	// so from the innermost to the outermost
+	got := spans.Spans()
+	if len(got) != 4 {
+		t.Fatalf("expected 4 spans; got %d", len(got))
+	}
+	backSrv, backCl, frontSrv, cli := got[0], got[1], got[2], got[3]
+	kinds := []SpanKind{SpanServer, SpanClient, SpanServer, SpanClient}
+	for i, s := range got {
+		if s.Kind != kinds[i] {
+			t.Errorf("span %d is a %s span", i, s.Kind)
+		}
+		if s.Context.TraceID != cli.Context.TraceID {
+			t.Errorf("span %d is in trace %s; expected %s", i, s.Context.TraceID, cli.Context.TraceID)
+		}
+		if s.Status != StatusOK {
+			t.Errorf("span %d has status %s", i, s.Status)
+		}
+		if s.Name != "echo" {
+			t.Errorf("span %d has name %q", i, s.Name)
+		}
+	}
+	if cli.Parent != (SpanID{}) {
+		t.Error("expected the outermost span to be a root span")
+	}
+	if frontSrv.Parent != cli.Context.SpanID ||
+		backCl.Parent != frontSrv.Context.SpanID ||
+		backSrv.Parent != backCl.Context.SpanID {
+		t.Error("spans aren't linked to their parents")
+	}
+
+	// errors are recorded
+	spans.Reset()
+	if err := cl.Call(Fail, nil, nil); err == nil {
+		t.Fatal("expected an error")
+	}
+	for _, s := range spans.Spans() {
+		if s.Status != StatusServerError {
+			t.Errorf("%s span has status %s", s.Kind, s.Status)
+		}
+	}
+}
@@ -0,0 +1,200 @@
+package synapse
+
+import (
+	"io"
+	"net"
+)
+
+const (
+	// default minimum size of a frame
+	// that is written without copying
+	defaultVectorThreshold = 2048
+
+	// maxBatch is the maximum number of
+	// buffers passed to a single writev(2),
+	// which is IOV_MAX on most systems
+	maxBatch = 1024
+
+	// size of the buffer that small
+	// frames are copied into
+	batchCopySize = 4096
+)
+
+// VectoredWrites makes connections write
+// queued messages with a single writev(2) system
+// call rather than copying them into a buffer
+// first. Messages smaller than 'threshold' bytes
+// are still copied into a shared buffer, since
+// that is cheaper than the extra I/O vector.
+// A threshold of 0 or less selects a default value.
+//
+// Vectored writes save a copy of large messages
+// on connections that implement writev(2), like
+// *net.TCPConn and *net.UnixConn. Other connections
+// (including TLS connections) receive one Write
+// call per buffer, so VectoredWrites should not
+// be used with them.
+func VectoredWrites(threshold int) Option {
+	return func(c *config) {
+		if threshold <= 0 {
+			threshold = defaultVectorThreshold
+		}
+		c.vector = threshold
+	}
+}
+
+// batch gathers frames for
+// a single vectored write.
+// frames smaller than 'thresh'
+// are copied into 'copied'; the
+// rest are referenced directly,
+// and must not be modified until
+// the batch is flushed.
+type batch struct {
+	bufs   net.Buffers
+	vec    net.Buffers // consumed by WriteTo
+	copied []byte
+	thresh int
+	tail   bool // the last buffer is the tail of 'copied'
+}
+
+func (b *batch) init(thresh int) {
+	b.thresh = thresh
+	b.copied = make([]byte, 0, batchCopySize)
+}
+
+func (b *batch) add(msg []byte) {
+	if len(msg) < b.thresh && len(b.copied)+len(msg) <= cap(b.copied) {
+		start := len(b.copied)
+		b.copied = append(b.copied, msg...)
+		if b.tail {
+			// the last buffer points into
+			// 'copied', so just extend it
+			last := &b.bufs[len(b.bufs)-1]
+			*last = (*last)[:len(*last)+len(msg)]
+		} else {
+			b.bufs = append(b.bufs, b.copied[start:])
+			b.tail = true
+		}
+		return
+	}
+	b.bufs = append(b.bufs, msg)
+	b.tail = false
+}
+
+// full returns whether or not
+// the batch should be flushed
+// before adding more frames
+func (b *batch) full() bool { return len(b.bufs) >= maxBatch }
+
+// flush writes the batch to 'w'
+// and resets it. after flush returns,
+// the frames passed to add may be
+// re-used.
+func (b *batch) flush(w io.Writer) error {
+	// WriteTo consumes its receiver,
+	// so it operates on a copy of the
+	// slice header
+	b.vec = b.bufs
+	_, err := b.vec.WriteTo(w)
+	b.vec = nil
+	for i := range b.bufs {
+		b.bufs[i] = nil
+	}
+	b.bufs = b.bufs[:0]
+	b.copied = b.copied[:0]
+	b.tail = false
+	return err
+}
+
+// writeLoopv is the version of
+// (*Client).writeLoop used with
+// VectoredWrites. waiters are held
+// until their frames are flushed.
+func (c *Client) writeLoopv() {
+	var (
+		b    batch
+		held []*waiter
+	)
+	b.init(c.cfg.vector)
+	for {
+		wt, ok := <-c.writing
+		if !ok {
+			return
+		}
+		b.add(wt.in)
+		held = append(held, wt)
+	more:
+		for !b.full() {
+			select {
+			case another, ok := <-c.writing:
+				if !ok {
+					b.flush(c.conn)
+					return
+				}
+				b.add(another.in)
+				held = append(held, another)
+				continue more
+			default:
+			}
+			break
+		}
+		err := b.flush(c.conn)
+		for i, w := range held {
+			c.unref(w)
+			held[i] = nil
+		}
+		held = held[:0]
+		if !c.do(0, err) {
+			return
+		}
+	}
+}
+
+// writeLoopv is the version of
+// (*connHandler).writeLoop used with
+// VectoredWrites. connWrappers are held
+// until their frames are written.
+func (c *connHandler) writeLoopv() {
+	var (
+		b    batch
+		held []*connWrapper
+	)
+	b.init(c.cfg.vector)
+	for {
+		cw, ok := <-c.writing
+		if !ok {
+			return
+		}
+		b.add(cw.res.out)
+		held = append(held, cw)
+	more:
+		for !b.full() {
+			select {
+			case another, ok := <-c.writing:
+				if !ok {
+					break more
+				}
+				b.add(another.res.out)
+				held = append(held, another)
+				continue more
+			default:
+			}
+			break
+		}
+		err := b.flush(c.conn)
+		for i, w := range held {
+			c.srv.wrappers.push(w)
+			held[i] = nil
+		}
+		held = held[:0]
+		if !c.do(0, err) {
+			// drain the queue so that
+			// handlers don't block
+			for w := range c.writing {
+				c.srv.wrappers.push(w)
+			}
+			return
+		}
+	}
+}
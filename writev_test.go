@@ -0,0 +1,125 @@
+package synapse
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestBatch(t *testing.T) {
+	var b batch
+	b.init(8)
+
+	small := [][]byte{[]byte("abc"), []byte("defg"), []byte("h")}
+	large := bytes.Repeat([]byte("x"), 16)
+
+	var want []byte
+	for _, s := range small {
+		b.add(s)
+		want = append(want, s...)
+	}
+	b.add(large)
+	want = append(want, large...)
+	b.add(small[0])
+	want = append(want, small[0]...)
+
+	// the small frames on either side of
+	// the large one are coalesced, and the
+	// large one is written in place
+	if len(b.bufs) != 3 {
+		t.Fatalf("expected 3 buffers; got %d", len(b.bufs))
+	}
+	if &b.bufs[1][0] != &large[0] {
+		t.Error("large frame was copied")
+	}
+
+	var out bytes.Buffer
+	if err := b.flush(&out); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.Bytes(), want) {
+		t.Errorf("wrote %q; expected %q", out.Bytes(), want)
+	}
+	if len(b.bufs) != 0 || len(b.copied) != 0 {
+		t.Error("batch not reset after flush")
+	}
+}
+
+// echoes messages of various sizes
+// with vectored writes on both ends
+func TestVectoredWrites(t *testing.T) {
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go Serve(l, EchoHandler{}, VectoredWrites(512))
+
+	cl, err := Dial("tcp", l.Addr().String(), time.Second, VectoredWrites(512))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cl.Close()
+
+	for _, size := range []int{0, 10, 511, 512, 4000, 60000} {
+		in := testData(bytes.Repeat([]byte{'v'}, size))
+		var out testData
+		if err := cl.Call(Echo, &in, &out); err != nil {
+			t.Fatalf("size %d: %s", size, err)
+		}
+		if !bytes.Equal(in, out) {
+			t.Errorf("size %d: echoed %d bytes", size, len(out))
+		}
+	}
+}
+
+// compares coalesced and vectored
+// writes at various message sizes
+func BenchmarkWrites(b *testing.B) {
+	modes := []struct {
+		name string
+		opts []Option
+	}{
+		{"coalesced", nil},
+		{"vectored", []Option{VectoredWrites(0)}},
+	}
+	for _, size := range []int{64, 1024, 8192, 60000} {
+		for _, m := range modes {
+			b.Run(fmt.Sprintf("%s/%d", m.name, size), func(b *testing.B) {
+				benchWrites(b, size, m.opts...)
+			})
+		}
+	}
+}
+
+func benchWrites(b *testing.B, size int, opts ...Option) {
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer l.Close()
+	go Serve(l, EchoHandler{}, opts...)
+
+	cl, err := Dial("tcp", l.Addr().String(), time.Second, opts...)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer cl.Close()
+
+	b.SetBytes(int64(2 * size))
+	b.ReportAllocs()
+	b.SetParallelism(20)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		in := testData(bytes.Repeat([]byte{'b'}, size))
+		var out testData
+		for pb.Next() {
+			if err := cl.Call(Echo, &in, &out); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.StopTimer()
+}